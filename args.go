@@ -10,6 +10,7 @@ import (
 	"os"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"unicode"
 
@@ -26,28 +27,78 @@ Released under the BSD 3-Clause License
 
 // binArgs is for argument parsing
 type binArgs struct {
-	Cmd         string   // this is not a command line flag, but rather parsed results
-	CmdArgs     []string // this is not a command line flag, also parsed results
-	LockDir     string   `short:"d" long:"lock-dir" default:"/var/lock" description:"the directory where lock files will be placed"`
-	AllEvents   bool     `short:"e" long:"event" description:"emit a start and end datadog event"`
-	FailEvent   bool     `short:"E" long:"event-fail" description:"only emit an event on failure"`
-	LogFail     bool     `short:"F" long:"log-fail" description:"when a command fails, log its full output (stdout/stderr) to the log directory using the UUID as the filename"`
-	Group       string   `short:"g" long:"group" value-name:"<group>" description:"emit a cronner_group:<group> tag with statsd metrics"`
-	EventGroup  string   `short:"G" long:"event-group" value-name:"<group>" description:"emit a cronner_group:<group> tag with Datadog events, does not get sent with statsd metrics"`
-	StatsdHost  string   `short:"H" long:"statsd-host" value-name:"<host>" description:"destination host to send datadog metrics"`
-	Lock        bool     `short:"k" long:"lock" description:"lock based on label so that multiple commands with the same label can not run concurrently"`
-	Label       string   `short:"l" long:"label" description:"name for cron job to be used in statsd emissions and DogStatsd events. alphanumeric only; cronner will lowercase it"`
-	LogPath     string   `long:"log-path" default:"/var/log/cronner" description:"where to place the log files for command output (path for -F/--log-fail output)"`
-	LogLevel    string   `short:"L" long:"log-level" default:"error" description:"set the level at which to log at [none|error|info|debug]"`
-	Namespace   string   `short:"N" long:"namespace" default:"cronner" description:"namespace for statsd emissions, value is prepended to metric name by statsd client"`
-	Passthru    bool     `short:"p" long:"passthru" description:"passthru stdout/stderr to controlling tty"`
-	Parent      bool     `short:"P" long:"use-parent" description:"if cronner invocation is runner under cronner, emit the parental values as tags"`
-	Sensitive   bool     `short:"s" long:"sensitive" description:"specify whether command output may contain sensitive details, this only avoids it being printed to stderr"`
-	Tags        []string `short:"t" long:"tag" description:"additional tags to add to datadog events and metrics (can be used multiple times), either <key>:<value> or <string> format"`
-	Version     bool     `short:"V" long:"version" description:"print the version string and exit"`
-	WarnAfter   uint64   `short:"w" long:"warn-after" default:"0" value-name:"N" description:"emit a warning event every N seconds if the job hasn't finished, set to 0 to disable"`
-	WaitSeconds uint64   `short:"W" long:"wait-secs" default:"0" description:"how long to wait for the file lock for"`
-	Args        struct {
+	Cmd                string   // this is not a command line flag, but rather parsed results
+	CmdArgs            []string // this is not a command line flag, also parsed results
+	RetryCodes         []int    // this is not a command line flag, parsed from RetryOnCodes
+	Limits             []rlimit // this is not a command line flag, parsed from the --limit-* flags
+	AlertAfterFailures uint64   `long:"alert-after-failures" default:"0" value-name:"N" description:"with -E/--event-fail, only emit the failure event once the job has failed N times in a row, and then on every failure until it succeeds; the state of previous runs is kept in the lock directory"`
+	Config             string   `long:"config" value-name:"<file>" description:"read the settings of the job selected with --job from this config file; flags given on the command line override the file"`
+	Job                string   `long:"job" value-name:"<name>" description:"the job in the --config file to run"`
+	LockDir            string   `short:"d" long:"lock-dir" default:"/var/lock" description:"the directory where lock files will be placed"`
+	LockFIFO           bool     `long:"lock-fifo" description:"when waiting for the file lock, queue up behind the other waiting processes so that they get the lock in the order they started waiting"`
+	LockBackend        string   `long:"lock-backend" default:"flock" value-name:"<flock|redis|lease>" description:"what -k/--lock uses for the lock: flock is a file lock in the lock directory, which only applies to this host, and redis is a key on the --redis-addr server, which applies to every host using it, and lease is a lease file in the lock directory, which applies to every host sharing it"`
+	LockTTL            uint64   `long:"lock-ttl" default:"30" value-name:"N" description:"with --lock-backend=redis or lease, how many seconds the lock is held for if it's not renewed; it's renewed every N/3 seconds while the command runs"`
+	RedisAddr          string   `long:"redis-addr" default:"127.0.0.1:6379" value-name:"<host:port>" description:"the address of the Redis server for --lock-backend=redis"`
+	RedisPassword      string   `long:"redis-password" env:"CRONNER_REDIS_PASSWORD" value-name:"<password>" description:"the password for the Redis server, if it needs one"`
+	OnLocked           string   `long:"on-locked" default:"fail" value-name:"<fail|skip|queue>" description:"what to do if the lock (or every --max-concurrent slot) is still held by another run after --wait-secs: fail with exit code 200, skip the run with exit code 0, or queue up for it in arrival order, waiting without a limit unless --wait-secs is given"`
+	AllEvents          bool     `short:"e" long:"event" description:"emit a start and end datadog event"`
+	FailEvent          bool     `short:"E" long:"event-fail" description:"only emit an event on failure"`
+	MaxConcurrent      uint64   `long:"max-concurrent" default:"0" value-name:"N" description:"allow up to N concurrent runs of the job, using N slot lock files in the lock directory; the slot is passed to the command in the CRONNER_SLOT environment variable"`
+	LogFail            bool     `short:"F" long:"log-fail" description:"when a command fails, log its full output (stdout/stderr) to the log directory using the UUID as the filename"`
+	EventRecovery      bool     `long:"event-recovery" description:"emit an event when the job succeeds after having failed (see --alert-after-failures); the state of previous runs is kept in the lock directory"`
+	EventOutput        string   `long:"event-output" default:"combined" value-name:"<combined|stdout|stderr|both>" description:"which output of the command to include in the completion event; all but combined also capture stdout and stderr separately, with -F/--log-fail writing each to its own timestamped log file"`
+	Group              string   `short:"g" long:"group" value-name:"<group>" description:"emit a cronner_group:<group> tag with statsd metrics"`
+	EventGroup         string   `short:"G" long:"event-group" value-name:"<group>" description:"emit a cronner_group:<group> tag with Datadog events, does not get sent with statsd metrics"`
+	HistoryDir         string   `long:"history-dir" default:"/var/lib/cronner/history" value-name:"<dir>" description:"record each run in the history store in this directory, if it exists (see cronner history --help)"`
+	HistoryRetention   uint64   `long:"history-retention" default:"30" value-name:"DAYS" description:"remove runs older than DAYS from the history store, set to 0 to keep them forever"`
+	StatsdHost         string   `short:"H" long:"statsd-host" value-name:"<host>" description:"destination host to send datadog metrics"`
+	Lock               bool     `short:"k" long:"lock" description:"lock based on label so that multiple commands with the same label can not run concurrently"`
+	Label              string   `short:"l" long:"label" description:"name for cron job to be used in statsd emissions and DogStatsd events. alphanumeric only; cronner will lowercase it"`
+	LimitAS            string   `long:"limit-as" value-name:"BYTES" description:"limit the command's virtual memory (address space) to BYTES, with an optional K, M, G, or T suffix, or unlimited"`
+	LimitCore          string   `long:"limit-core" value-name:"BYTES" description:"limit the size of the command's core dumps to BYTES, with an optional K, M, G, or T suffix, or unlimited; 0 turns them off"`
+	LimitCPU           string   `long:"limit-cpu" value-name:"N" description:"limit the command to N seconds of CPU time, or unlimited; it's sent SIGXCPU when it reaches it, and SIGKILL a second later"`
+	LimitNofile        string   `long:"limit-nofile" value-name:"N" description:"limit the command to N open files, or unlimited"`
+	LimitNproc         string   `long:"limit-nproc" value-name:"N" description:"limit the number of processes the command's user can have to N, or unlimited"`
+	Cgroup             bool     `long:"cgroup" description:"run the command in a cgroup v2 of its own under --cgroup-parent, to emit the resource usage and OOM kills of everything it runs as metrics and to set the --cgroup-*-max limits"`
+	CgroupParent       string   `long:"cgroup-parent" default:"/sys/fs/cgroup/cronner" value-name:"<dir>" description:"the cgroup to create the command's cgroup in with --cgroup; it's created if it doesn't exist"`
+	CgroupMemoryMax    string   `long:"cgroup-memory-max" value-name:"BYTES" description:"with --cgroup, limit the memory use of everything the command runs to BYTES, with an optional K, M, G, or T suffix, past which the OOM killer is used"`
+	CgroupCPUMax       string   `long:"cgroup-cpu-max" value-name:"CPUS" description:"with --cgroup, limit the CPU use of everything the command runs to CPUS, like 0.5 for half of a CPU"`
+	CgroupPidsMax      uint64   `long:"cgroup-pids-max" default:"0" value-name:"N" description:"with --cgroup, limit the number of processes the command runs to N, set to 0 to disable"`
+	Nice               int      `long:"nice" default:"0" value-name:"N" description:"run the command with a niceness of N, from -20 (the highest priority) to 19 (the lowest); 0 leaves it as is, and lowering it needs root"`
+	IoniceClass        string   `long:"ionice-class" value-name:"<realtime|best-effort|idle>" description:"run the command in this I/O scheduling class; realtime needs root, and idle only gets disk time when nothing else wants it (Linux only)"`
+	IoniceLevel        int      `long:"ionice-level" default:"4" value-name:"N" description:"the priority within --ionice-class for the realtime and best-effort classes, from 0 (the highest) to 7 (the lowest)"`
+	Splay              string   `long:"splay" value-name:"MAXDURATION" description:"wait a random delay of up to MAXDURATION, like 90s or 10m, before taking the lock and running the command, to spread out jobs started at the same time on many hosts"`
+	SplayByHost        bool     `long:"splay-by-host" description:"with --splay, pick the delay from a hash of the hostname and label instead, so the job always runs at the same offset on a host"`
+	LogPath            string   `long:"log-path" default:"/var/log/cronner" description:"where to place the log files for command output (path for -F/--log-fail output)"`
+	LogLevel           string   `short:"L" long:"log-level" default:"error" description:"set the level at which to log at [none|error|info|debug]"`
+	Namespace          string   `short:"N" long:"namespace" default:"cronner" description:"namespace for statsd emissions, value is prepended to metric name by statsd client"`
+	NoStatsd           bool     `long:"no-statsd" description:"do not send any statsd metrics, DogStatsD events, or service checks"`
+	OutputHead         uint64   `long:"output-head" value-name:"BYTES" description:"only keep the first BYTES of the command's output in memory (see --output-tail); with -F/--log-fail the complete output is streamed to disk instead"`
+	OutputTail         uint64   `long:"output-tail" value-name:"BYTES" description:"only keep the last BYTES of the command's output in memory (see --output-head); with -F/--log-fail the complete output is streamed to disk instead"`
+	Passthru           bool     `short:"p" long:"passthru" description:"passthru stdout/stderr to controlling tty"`
+	Parent             bool     `short:"P" long:"use-parent" description:"if cronner invocation is runner under cronner, emit the parental values as tags"`
+	PromTextfileDir    string   `long:"prom-textfile-dir" value-name:"<dir>" description:"after each run, write its results to <dir>/cronner_<label>.prom for the Prometheus node_exporter textfile collector"`
+	Retries            uint64   `long:"retries" default:"0" value-name:"N" description:"re-run the command up to N more times if it fails, holding the lock across all attempts"`
+	RetryBackoff       string   `long:"retry-backoff" default:"fixed" value-name:"<fixed|exponential>" description:"fixed waits --retry-delay seconds between attempts, exponential doubles the delay after each attempt and adds random jitter"`
+	RetryDelay         uint64   `long:"retry-delay" default:"1" value-name:"N" description:"how many seconds to wait before retrying a failed command"`
+	RetryOnCodes       string   `long:"retry-on-exit-codes" value-name:"<codes>" description:"comma separated list of exit codes that should be retried, by default any failure is retried"`
+	Rusage             bool     `long:"rusage" description:"emit the command's resource usage (CPU time, max RSS, block I/O, context switches) as metrics and include it in the completion event"`
+	Sensitive          bool     `short:"s" long:"sensitive" description:"specify whether the command or its output may contain sensitive details; this avoids the output being printed to stderr, and leaves the command's arguments out of the history and the lock holder"`
+	ServiceCheck       bool     `long:"service-check" description:"emit a <namespace>.<label>.status DogStatsD service check with the status of the job"`
+	SlackWebhookURL    string   `long:"slack-webhook-url" value-name:"<url>" description:"POST a message to this Slack incoming webhook whenever a completion event would be emitted (see -e/--event and -E/--event-fail)"`
+	Tags               []string `short:"t" long:"tag" description:"additional tags to add to datadog events and metrics (can be used multiple times), either <key>:<value> or <string> format"`
+	Timeout            uint64   `long:"timeout" default:"0" value-name:"N" description:"kill the command (and its process group) if it hasn't finished after N seconds, set to 0 to disable"`
+	TimeoutGrace       uint64   `long:"timeout-grace" default:"10" value-name:"N" description:"how many seconds to wait after sending SIGTERM to a timed out command before sending SIGKILL"`
+	User               string   `long:"user" value-name:"<user>" description:"run the command as this user, by name or uid, instead of as cronner's user; the command keeps cronner's environment, and the lock and log files are handed over to the user"`
+	UserGroup          string   `long:"user-group" value-name:"<group>" description:"run the command with this group, by name or gid, instead of the primary group of --user"`
+	SuppGroups         string   `long:"supplementary-groups" value-name:"<groups>" description:"comma separated list of the supplementary groups to run the command with, by name or gid, instead of the groups --user is a member of"`
+	Version            bool     `short:"V" long:"version" description:"print the version string and exit"`
+	WebhookURL         string   `long:"webhook-url" value-name:"<url>" description:"POST a JSON summary of the run to this URL whenever a completion event would be emitted (see -e/--event and -E/--event-fail)"`
+	WebhookTimeout     uint64   `long:"webhook-timeout" default:"5" value-name:"N" description:"how many seconds to wait for a webhook to respond"`
+	WebhookRetries     uint64   `long:"webhook-retries" default:"2" value-name:"N" description:"how many times to retry a webhook that failed or responded with a server error"`
+	WarnAfter          uint64   `short:"w" long:"warn-after" default:"0" value-name:"N" description:"emit a warning event every N seconds if the job hasn't finished, set to 0 to disable"`
+	WaitSeconds        uint64   `short:"W" long:"wait-secs" default:"0" description:"how long to wait for the file lock for"`
+	Args               struct {
 		Command []string `positional-arg-name:"-- command [arguments]"`
 	} `positional-args:"yes" required:"true"`
 }
@@ -83,6 +134,12 @@ func (a *binArgs) parse(args []string) (string, error) {
 		return "", err
 	}
 
+	if len(a.Config) > 0 || len(a.Job) > 0 {
+		if err = a.applyConfig(args[1:]); err != nil {
+			return "", err
+		}
+	}
+
 	if a.Version {
 		out := fmt.Sprintf(
 			appVersionString,
@@ -117,6 +174,69 @@ func (a *binArgs) parse(args []string) (string, error) {
 		a.CmdArgs = a.Args.Command[1:]
 	}
 
+	switch strings.ToLower(a.RetryBackoff) {
+	case retryBackoffFixed, retryBackoffExponential:
+		a.RetryBackoff = strings.ToLower(a.RetryBackoff)
+	default:
+		return "", fmt.Errorf("%v is not a known retry backoff, try fixed or exponential", a.RetryBackoff)
+	}
+
+	switch strings.ToLower(a.EventOutput) {
+	case eventOutputCombined, eventOutputStdout, eventOutputStderr, eventOutputBoth:
+		a.EventOutput = strings.ToLower(a.EventOutput)
+	default:
+		return "", fmt.Errorf("%v is not a known event output, try combined, stdout, stderr, or both", a.EventOutput)
+	}
+
+	switch strings.ToLower(a.LockBackend) {
+	case lockBackendFlock, lockBackendRedis, lockBackendLease:
+		a.LockBackend = strings.ToLower(a.LockBackend)
+	default:
+		return "", fmt.Errorf("%v is not a known lock backend, try flock, redis, or lease", a.LockBackend)
+	}
+
+	if a.LockTTL == 0 {
+		return "", fmt.Errorf("lock TTL must be greater than zero")
+	}
+
+	switch strings.ToLower(a.OnLocked) {
+	case onLockedFail, onLockedSkip, onLockedQueue:
+		a.OnLocked = strings.ToLower(a.OnLocked)
+	default:
+		return "", fmt.Errorf("%v is not a known on-locked behavior, try fail, skip, or queue", a.OnLocked)
+	}
+
+	if a.Limits, err = parseRlimits(a); err != nil {
+		return "", err
+	}
+
+	settings, err := cgroupSettings(a)
+	if err != nil {
+		return "", err
+	}
+
+	if len(settings) > 0 && !a.Cgroup {
+		return "", fmt.Errorf("--cgroup-memory-max, --cgroup-cpu-max, and --cgroup-pids-max can only be used with --cgroup")
+	}
+
+	if _, err = parseSplay(a.Splay); err != nil {
+		return "", err
+	}
+
+	if err = validatePriority(a); err != nil {
+		return "", err
+	}
+
+	if len(a.RetryOnCodes) > 0 {
+		for _, code := range strings.Split(a.RetryOnCodes, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(code))
+			if err != nil {
+				return "", fmt.Errorf("retry exit code '%v' is invalid, it must be an integer", code)
+			}
+			a.RetryCodes = append(a.RetryCodes, n)
+		}
+	}
+
 	// lowercase the metric and replace spaces with underscores
 	// to try and encourage sanity
 	a.Label = strings.Replace(strings.ToLower(a.Label), " ", "_", -1)
@@ -139,3 +259,41 @@ func (a *binArgs) parse(args []string) (string, error) {
 
 	return "", nil
 }
+
+// applyConfig populates the arguments from the job's settings in the config
+// file, by parsing them as if they were given on the command line before the
+// actual arguments, so that those take precedence; the command comes from the
+// config file only if one wasn't given on the command line
+func (a *binArgs) applyConfig(cliArgs []string) error {
+	if len(a.Config) == 0 {
+		return fmt.Errorf("--job can only be used with --config")
+	}
+
+	if len(a.Job) == 0 {
+		return fmt.Errorf("--config requires --job to select the job to run")
+	}
+
+	cfg, err := loadConfig(a.Config)
+	if err != nil {
+		return err
+	}
+
+	fileArgs, command, err := cfg.jobArgs(a.Job)
+	if err != nil {
+		return err
+	}
+
+	*a = binArgs{}
+
+	p := flags.NewParser(a, flags.HelpFlag|flags.PassDoubleDash)
+
+	if _, err = p.ParseArgs(append(fileArgs, cliArgs...)); err != nil {
+		return err
+	}
+
+	if len(a.Args.Command) == 0 {
+		a.Args.Command = command
+	}
+
+	return nil
+}
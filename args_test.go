@@ -97,20 +97,69 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(len(output), Equals, 0)
 	c.Check(args.LockDir, Equals, "/var/lock")
+	c.Check(args.Config, Equals, "")
+	c.Check(args.Job, Equals, "")
 	c.Check(args.AllEvents, Equals, false)
 	c.Check(args.FailEvent, Equals, false)
 	c.Check(args.LogFail, Equals, false)
 	c.Check(args.EventGroup, Equals, "")
+	c.Check(args.EventOutput, Equals, "combined")
+	c.Check(args.EventRecovery, Equals, false)
+	c.Check(args.AlertAfterFailures, Equals, uint64(0))
 	c.Check(args.Group, Equals, "")
+	c.Check(args.HistoryDir, Equals, "/var/lib/cronner/history")
+	c.Check(args.HistoryRetention, Equals, uint64(30))
 	c.Check(args.Lock, Equals, false)
+	c.Check(args.MaxConcurrent, Equals, uint64(0))
+	c.Check(args.LockFIFO, Equals, false)
+	c.Check(args.OnLocked, Equals, "fail")
+	c.Check(args.LockBackend, Equals, "flock")
+	c.Check(args.LockTTL, Equals, uint64(30))
+	c.Check(args.RedisAddr, Equals, "127.0.0.1:6379")
+	c.Check(args.RedisPassword, Equals, "")
+	c.Check(args.User, Equals, "")
+	c.Check(args.UserGroup, Equals, "")
+	c.Check(args.SuppGroups, Equals, "")
+	c.Check(args.LimitAS, Equals, "")
+	c.Check(args.LimitCore, Equals, "")
+	c.Check(args.LimitCPU, Equals, "")
+	c.Check(args.LimitNofile, Equals, "")
+	c.Check(args.LimitNproc, Equals, "")
+	c.Check(args.Limits, HasLen, 0)
+	c.Check(args.Cgroup, Equals, false)
+	c.Check(args.CgroupParent, Equals, "/sys/fs/cgroup/cronner")
+	c.Check(args.CgroupMemoryMax, Equals, "")
+	c.Check(args.CgroupCPUMax, Equals, "")
+	c.Check(args.CgroupPidsMax, Equals, uint64(0))
+	c.Check(args.Nice, Equals, 0)
+	c.Check(args.IoniceClass, Equals, "")
+	c.Check(args.IoniceLevel, Equals, 4)
+	c.Check(args.Splay, Equals, "")
+	c.Check(args.SplayByHost, Equals, false)
 	c.Check(args.LogPath, Equals, "/var/log/cronner")
 	c.Check(args.LogLevel, Equals, "error")
 	c.Check(args.Namespace, Equals, "cronner")
 	c.Check(args.Parent, Equals, false)
+	c.Check(args.NoStatsd, Equals, false)
+	c.Check(args.OutputHead, Equals, uint64(0))
+	c.Check(args.OutputTail, Equals, uint64(0))
 	c.Check(args.Passthru, Equals, false)
+	c.Check(args.PromTextfileDir, Equals, "")
+	c.Check(args.Rusage, Equals, false)
+	c.Check(args.Retries, Equals, uint64(0))
+	c.Check(args.RetryBackoff, Equals, "fixed")
+	c.Check(args.RetryDelay, Equals, uint64(1))
+	c.Check(args.RetryCodes, HasLen, 0)
 	c.Check(args.Sensitive, Equals, false)
+	c.Check(args.ServiceCheck, Equals, false)
+	c.Check(args.SlackWebhookURL, Equals, "")
 	c.Check(args.Tags, HasLen, 0)
+	c.Check(args.Timeout, Equals, uint64(0))
+	c.Check(args.TimeoutGrace, Equals, uint64(10))
 	c.Check(args.Version, Equals, false)
+	c.Check(args.WebhookURL, Equals, "")
+	c.Check(args.WebhookTimeout, Equals, uint64(5))
+	c.Check(args.WebhookRetries, Equals, uint64(2))
 	c.Check(args.WarnAfter, Equals, uint64(0))
 	c.Check(args.WaitSeconds, Equals, uint64(0))
 
@@ -183,6 +232,35 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 		"--event-fail",
 		"--log-fail",
 		"--event-group", "test_group",
+		"--event-output", "Both",
+		"--event-recovery",
+		"--alert-after-failures", "3",
+		"--history-dir", "/var/lib/testcronner",
+		"--history-retention", "7",
+		"--max-concurrent", "3",
+		"--lock-fifo",
+		"--on-locked", "Skip",
+		"--lock-backend", "Redis",
+		"--lock-ttl", "60",
+		"--redis-addr", "redis.example.com:6380",
+		"--redis-password", "hunter2",
+		"--user", "nobody",
+		"--user-group", "nogroup",
+		"--supplementary-groups", "adm,staff",
+		"--limit-as", "1G",
+		"--limit-core", "0",
+		"--limit-cpu", "3600",
+		"--limit-nofile", "256",
+		"--limit-nproc", "unlimited",
+		"--cgroup",
+		"--cgroup-parent", "/sys/fs/cgroup/jobs",
+		"--cgroup-memory-max", "2G",
+		"--cgroup-cpu-max", "0.5",
+		"--cgroup-pids-max", "100",
+		"--nice", "10",
+		"--ionice-level", "6",
+		"--splay", "15m",
+		"--splay-by-host",
 		"--group", "metric_group",
 		"--statsd-host", "test_host",
 		"--lock",
@@ -191,10 +269,26 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 		"--log-level", "info",
 		"--namespace", "testcronner",
 		"--use-parent",
+		"--no-statsd",
+		"--output-head", "1024",
+		"--output-tail", "2048",
 		"--passthru",
+		"--prom-textfile-dir", "/var/lib/node_exporter",
+		"--retries", "3",
+		"--retry-backoff", "Exponential",
+		"--retry-delay", "5",
+		"--retry-on-exit-codes", "1, 75",
+		"--rusage",
 		"--sensitive",
+		"--service-check",
+		"--slack-webhook-url", "https://hooks.slack.com/services/T0/B0/X",
 		"--tag", "tag1",
 		"--tag", "tag2",
+		"--timeout", "120",
+		"--timeout-grace", "5",
+		"--webhook-url", "https://example.com/hook",
+		"--webhook-timeout", "3",
+		"--webhook-retries", "4",
 		"--warn-after", "42",
 		"--wait-secs", "84",
 		"--", "/bin/true",
@@ -210,6 +304,36 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 	c.Check(args.FailEvent, Equals, true)
 	c.Check(args.LogFail, Equals, true)
 	c.Check(args.EventGroup, Equals, "test_group")
+	c.Check(args.EventOutput, Equals, "both")
+	c.Check(args.EventRecovery, Equals, true)
+	c.Check(args.AlertAfterFailures, Equals, uint64(3))
+	c.Check(args.HistoryDir, Equals, "/var/lib/testcronner")
+	c.Check(args.HistoryRetention, Equals, uint64(7))
+	c.Check(args.MaxConcurrent, Equals, uint64(3))
+	c.Check(args.LockFIFO, Equals, true)
+	c.Check(args.OnLocked, Equals, "skip")
+	c.Check(args.LockBackend, Equals, "redis")
+	c.Check(args.LockTTL, Equals, uint64(60))
+	c.Check(args.RedisAddr, Equals, "redis.example.com:6380")
+	c.Check(args.RedisPassword, Equals, "hunter2")
+	c.Check(args.User, Equals, "nobody")
+	c.Check(args.UserGroup, Equals, "nogroup")
+	c.Check(args.SuppGroups, Equals, "adm,staff")
+	c.Check(args.LimitAS, Equals, "1G")
+	c.Check(args.LimitCore, Equals, "0")
+	c.Check(args.LimitCPU, Equals, "3600")
+	c.Check(args.LimitNofile, Equals, "256")
+	c.Check(args.LimitNproc, Equals, "unlimited")
+	c.Check(args.Limits, HasLen, 5)
+	c.Check(args.Cgroup, Equals, true)
+	c.Check(args.CgroupParent, Equals, "/sys/fs/cgroup/jobs")
+	c.Check(args.CgroupMemoryMax, Equals, "2G")
+	c.Check(args.CgroupCPUMax, Equals, "0.5")
+	c.Check(args.CgroupPidsMax, Equals, uint64(100))
+	c.Check(args.Nice, Equals, 10)
+	c.Check(args.IoniceLevel, Equals, 6)
+	c.Check(args.Splay, Equals, "15m")
+	c.Check(args.SplayByHost, Equals, true)
 	c.Check(args.Group, Equals, "metric_group")
 	c.Check(args.StatsdHost, Equals, "test_host")
 	c.Check(args.Lock, Equals, true)
@@ -219,11 +343,27 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 	c.Check(args.Namespace, Equals, "testcronner")
 	c.Check(args.Parent, Equals, true)
 	c.Check(args.Passthru, Equals, true)
+	c.Check(args.NoStatsd, Equals, true)
+	c.Check(args.OutputHead, Equals, uint64(1024))
+	c.Check(args.OutputTail, Equals, uint64(2048))
+	c.Check(args.PromTextfileDir, Equals, "/var/lib/node_exporter")
+	c.Check(args.Retries, Equals, uint64(3))
+	c.Check(args.RetryBackoff, Equals, "exponential")
+	c.Check(args.RetryDelay, Equals, uint64(5))
+	c.Check(args.RetryCodes, DeepEquals, []int{1, 75})
+	c.Check(args.Rusage, Equals, true)
 	c.Check(args.Sensitive, Equals, true)
+	c.Check(args.ServiceCheck, Equals, true)
+	c.Check(args.SlackWebhookURL, Equals, "https://hooks.slack.com/services/T0/B0/X")
 	c.Assert(args.Tags, HasLen, 2)
 	c.Check(args.Tags[0], Equals, "tag1")
 	c.Check(args.Tags[1], Equals, "tag2")
+	c.Check(args.Timeout, Equals, uint64(120))
+	c.Check(args.TimeoutGrace, Equals, uint64(5))
 	c.Check(args.Version, Equals, false)
+	c.Check(args.WebhookURL, Equals, "https://example.com/hook")
+	c.Check(args.WebhookTimeout, Equals, uint64(3))
+	c.Check(args.WebhookRetries, Equals, uint64(4))
 	c.Check(args.WarnAfter, Equals, uint64(42))
 	c.Check(args.WaitSeconds, Equals, uint64(84))
 	c.Check(args.Cmd, Equals, "/bin/true")
@@ -319,6 +459,221 @@ func (t *TestSuite) Test_binArgs_parse(c *C) {
 	c.Check(len(output), Equals, 0)
 	c.Check(err.Error(), Equals, fmt.Sprintf("tag '%v' is invalid, tags must be less than 200 characters", tag))
 
+	//
+	// assert that the retry options are validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--retry-backoff", "linear",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "linear is not a known retry backoff, try fixed or exponential")
+
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--retry-on-exit-codes", "1,two",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "retry exit code 'two' is invalid, it must be an integer")
+
+	//
+	// assert that the event output is validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--event-output", "stdin",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "stdin is not a known event output, try combined, stdout, stderr, or both")
+
+	//
+	// assert that the on-locked behavior is validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--on-locked", "ignore",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "ignore is not a known on-locked behavior, try fail, skip, or queue")
+
+	//
+	// assert that the resource limits are validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--limit-cpu", "1h",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--limit-cpu value '1h' is invalid, it must be a number or unlimited")
+
+	//
+	// assert that the cgroup limits are validated, and need --cgroup
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--cgroup",
+		"--cgroup-cpu-max", "none",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--cgroup-cpu-max value 'none' is invalid, it must be a number of CPUs greater than zero")
+
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--cgroup-pids-max", "10",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--cgroup-memory-max, --cgroup-cpu-max, and --cgroup-pids-max can only be used with --cgroup")
+
+	//
+	// assert that the splay is validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--splay", "later",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--splay value 'later' is invalid, it must be a duration like 90s or 10m, or a number of seconds")
+
+	//
+	// assert that the scheduling priorities are validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--nice", "20",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--nice value '20' is invalid, it must be from -20 to 19")
+
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--ionice-class", "Best-Effort",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+
+	if ioprioSupported {
+		c.Assert(err, IsNil)
+		c.Check(args.IoniceClass, Equals, "best-effort")
+	} else {
+		c.Assert(err, Not(IsNil))
+		c.Check(len(output), Equals, 0)
+		c.Check(err.Error(), Equals, "--ionice-class is only supported on Linux")
+	}
+
+	if ioprioSupported {
+		args = &binArgs{}
+		cli = []string{
+			Arg0,
+			"-l", "test",
+			"--ionice-class", "lazy",
+			"--", "/bin/true",
+		}
+
+		output, err = args.parse(cli)
+		c.Assert(err, Not(IsNil))
+		c.Check(len(output), Equals, 0)
+		c.Check(err.Error(), Equals, "lazy is not a known I/O scheduling class, try realtime, best-effort, or idle")
+	}
+
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--ionice-level", "8",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "--ionice-level value '8' is invalid, it must be from 0 to 7")
+
+	//
+	// assert that the lock backend is validated
+	//
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--lock-backend", "etcd",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "etcd is not a known lock backend, try flock, redis, or lease")
+
+	args = &binArgs{}
+	cli = []string{
+		Arg0,
+		"-l", "test",
+		"--lock-ttl", "0",
+		"--", "/bin/true",
+	}
+
+	output, err = args.parse(cli)
+	c.Assert(err, Not(IsNil))
+	c.Check(len(output), Equals, 0)
+	c.Check(err.Error(), Equals, "lock TTL must be greater than zero")
+
 	//
 	// argument parsing regression tests
 	//
@@ -0,0 +1,58 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// writeTempFile writes the contents to a new temporary file in the same
+// directory as filename, and returns its name. It's hidden and named after
+// filename, so it's easy to tell what it's for if it's left behind.
+func writeTempFile(filename string, contents []byte, perm os.FileMode) (string, error) {
+	dir, file := path.Split(filename)
+
+	tmpFile, err := ioutil.TempFile(dir, fmt.Sprintf(".%v.", file))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file for '%v': %v", filename, err)
+	}
+
+	tmpName := tmpFile.Name()
+
+	if _, err = tmpFile.Write(contents); err == nil {
+		err = tmpFile.Chmod(perm)
+	}
+
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+		return "", fmt.Errorf("failed to write temporary file '%v': %v", tmpName, err)
+	}
+
+	return tmpName, nil
+}
+
+// writeFileAtomic replaces filename with a file of the contents. The contents
+// are written to a temporary file first, which is then renamed over filename,
+// so nothing reading filename ever sees it partially written.
+func writeFileAtomic(filename string, contents []byte, perm os.FileMode) error {
+	tmpName, err := writeTempFile(filename, contents, perm)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpName, filename); err != nil {
+		os.Remove(tmpName)
+		return fmt.Errorf("failed to move '%v' into place: %v", filename, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_writeFileAtomic(c *C) {
+	dir := c.MkDir()
+	filename := path.Join(dir, "state.json")
+
+	c.Assert(writeFileAtomic(filename, []byte("first\n"), 0600), IsNil)
+	c.Assert(writeFileAtomic(filename, []byte("second\n"), 0644), IsNil)
+
+	contents, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "second\n")
+
+	stat, err := os.Stat(filename)
+	c.Assert(err, IsNil)
+	c.Check(stat.Mode().Perm(), Equals, os.FileMode(0644))
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+
+	err = writeFileAtomic(path.Join(dir, "missing", "state.json"), []byte("third\n"), 0600)
+	c.Assert(err, Not(IsNil))
+}
@@ -0,0 +1,233 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// outputBuffer is where the output of the command is captured; it's satisfied
+// by both *bytes.Buffer and *outputCapture
+type outputBuffer interface {
+	io.Writer
+	Bytes() []byte
+	Reset()
+}
+
+// outputCapture is an outputBuffer that only keeps the first headSize and the
+// last tailSize bytes of the output in memory, so a chatty command can't make
+// cronner run out of memory. The complete output can optionally be streamed to
+// a spill file on disk.
+type outputCapture struct {
+	mu sync.Mutex
+
+	headSize int
+	tailSize int
+
+	head []byte
+
+	// tail is a ring buffer, with tailPos being where the next byte will be
+	// written and tailLen how many bytes of it are in use
+	tail    []byte
+	tailPos int
+	tailLen int
+
+	// total is the number of bytes written, including those that were elided
+	total int64
+
+	spill    *os.File
+	spillErr error
+}
+
+func newOutputCapture(headSize, tailSize int) *outputCapture {
+	return &outputCapture{
+		headSize: headSize,
+		tailSize: tailSize,
+		head:     make([]byte, 0, headSize),
+		tail:     make([]byte, tailSize),
+	}
+}
+
+// Write captures p; it never returns an error, as failing to capture the
+// output shouldn't cause the command to fail
+func (o *outputCapture) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.total += int64(len(p))
+
+	if o.spill != nil && o.spillErr == nil {
+		_, o.spillErr = o.spill.Write(p)
+	}
+
+	n := len(p)
+
+	if free := o.headSize - len(o.head); free > 0 {
+		if free > len(p) {
+			free = len(p)
+		}
+
+		o.head = append(o.head, p[:free]...)
+		p = p[free:]
+	}
+
+	o.writeTail(p)
+
+	return n, nil
+}
+
+func (o *outputCapture) writeTail(p []byte) {
+	if o.tailSize == 0 || len(p) == 0 {
+		return
+	}
+
+	// only the last tailSize bytes can survive
+	if len(p) > o.tailSize {
+		p = p[len(p)-o.tailSize:]
+	}
+
+	n := copy(o.tail[o.tailPos:], p)
+	copy(o.tail, p[n:])
+
+	o.tailPos = (o.tailPos + len(p)) % o.tailSize
+
+	if o.tailLen += len(p); o.tailLen > o.tailSize {
+		o.tailLen = o.tailSize
+	}
+}
+
+// elided returns how many bytes of output were not kept in memory
+func (o *outputCapture) elided() int64 {
+	return o.total - int64(len(o.head)) - int64(o.tailLen)
+}
+
+// Bytes returns the captured head and tail of the output, with a marker in
+// between them saying how many bytes were elided
+func (o *outputCapture) Bytes() []byte {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var buf bytes.Buffer
+
+	buf.Write(o.head)
+
+	if elided := o.elided(); elided > 0 {
+		fmt.Fprintf(&buf, "\n=== %d BYTES ELIDED ===\n", elided)
+	}
+
+	if o.tailLen < o.tailSize {
+		buf.Write(o.tail[:o.tailLen])
+	} else {
+		buf.Write(o.tail[o.tailPos:])
+		buf.Write(o.tail[:o.tailPos])
+	}
+
+	return buf.Bytes()
+}
+
+// Reset throws away everything captured so far, including the contents of the
+// spill file
+func (o *outputCapture) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.head = o.head[:0]
+	o.tailPos, o.tailLen = 0, 0
+	o.total = 0
+
+	if o.spill != nil && o.spillErr == nil {
+		if o.spillErr = o.spill.Truncate(0); o.spillErr == nil {
+			_, o.spillErr = o.spill.Seek(0, io.SeekStart)
+		}
+	}
+}
+
+// Len returns the total number of bytes written, including those that were
+// elided
+func (o *outputCapture) Len() int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.total
+}
+
+// openSpill creates the file the complete output is streamed to
+func (o *outputCapture) openSpill(filename string) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.spill = file
+	o.mu.Unlock()
+
+	return nil
+}
+
+// spilling returns whether the complete output is being streamed to a spill
+// file
+func (o *outputCapture) spilling() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.spill != nil
+}
+
+// keepSpill closes the spill file and moves it to filename, making it
+// read-only like the files written by writeOutput
+func (o *outputCapture) keepSpill(filename string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	spill := o.spill
+	o.spill = nil
+
+	if spill == nil {
+		return fmt.Errorf("no spill file")
+	}
+
+	defer spill.Close()
+
+	if o.spillErr != nil {
+		os.Remove(spill.Name())
+		return fmt.Errorf("error writing to spill file '%v': %v", spill.Name(), o.spillErr)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		os.Remove(spill.Name())
+		return fmt.Errorf("flagrant error: output file '%v' already exists", filename)
+	}
+
+	if err := spill.Chmod(0400); err != nil {
+		os.Remove(spill.Name())
+		return fmt.Errorf("error setting permissions (0400) on file '%v': %v", spill.Name(), err)
+	}
+
+	if err := os.Rename(spill.Name(), filename); err != nil {
+		os.Remove(spill.Name())
+		return fmt.Errorf("error moving spill file '%v' to '%v': %v", spill.Name(), filename, err)
+	}
+
+	return nil
+}
+
+// removeSpill closes and removes the spill file, if there is one
+func (o *outputCapture) removeSpill() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.spill == nil {
+		return
+	}
+
+	o.spill.Close()
+	os.Remove(o.spill.Name())
+	o.spill = nil
+}
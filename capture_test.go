@@ -0,0 +1,146 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_outputCapture(c *C) {
+	o := newOutputCapture(4, 6)
+
+	// everything fits
+	o.Write([]byte("abc"))
+	o.Write([]byte("defg"))
+	c.Check(string(o.Bytes()), Equals, "abcdefg")
+	c.Check(o.Len(), Equals, int64(7))
+
+	// the tail wraps around
+	o.Write([]byte("hij"))
+	o.Write([]byte("kl"))
+	c.Check(string(o.Bytes()), Equals, "abcd\n=== 2 BYTES ELIDED ===\ngh"+"ijkl")
+	c.Check(o.Len(), Equals, int64(12))
+
+	// a write bigger than the tail only keeps its end
+	o.Write([]byte("0123456789"))
+	c.Check(string(o.Bytes()), Equals, "abcd\n=== 12 BYTES ELIDED ===\n456789")
+
+	o.Reset()
+	c.Check(string(o.Bytes()), Equals, "")
+	c.Check(o.Len(), Equals, int64(0))
+
+	o.Write([]byte("xyz"))
+	c.Check(string(o.Bytes()), Equals, "xyz")
+
+	// only a head
+	o = newOutputCapture(3, 0)
+	o.Write([]byte("abcdef"))
+	c.Check(string(o.Bytes()), Equals, "abc\n=== 3 BYTES ELIDED ===\n")
+}
+
+func (*TestSuite) Test_outputCapture_spill(c *C) {
+	dir := c.MkDir()
+	spillName := path.Join(dir, "spill")
+	filename := path.Join(dir, "out")
+
+	o := newOutputCapture(2, 2)
+	c.Assert(o.openSpill(spillName), IsNil)
+	c.Check(o.spilling(), Equals, true)
+
+	// the spill file must not already exist
+	c.Check(newOutputCapture(2, 2).openSpill(spillName), Not(IsNil))
+
+	o.Write([]byte("first attempt"))
+	o.Reset()
+	o.Write([]byte("second attempt"))
+
+	c.Assert(o.keepSpill(filename), IsNil)
+	c.Check(o.spilling(), Equals, false)
+
+	contents, err := ioutil.ReadFile(filename)
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "second attempt")
+
+	stat, err := os.Stat(filename)
+	c.Assert(err, IsNil)
+	c.Check(stat.Mode(), Equals, os.FileMode(0400))
+
+	_, err = os.Stat(spillName)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// removing the spill file
+	o = newOutputCapture(2, 2)
+	c.Assert(o.openSpill(spillName), IsNil)
+	o.removeSpill()
+
+	_, err = os.Stat(spillName)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (*TestSuite) Test_handleCommand_outputCapture(c *C) {
+	r := &recordingEmitter{}
+	logDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:      "testCmd",
+			LockDir:    c.MkDir(),
+			LogPath:    logDir,
+			LogFail:    true,
+			OutputHead: 6,
+			OutputTail: 6,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 1000 ]; do echo $i; i=$((i+1)); done; exit 1"),
+	}
+
+	var expected bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&expected, "%d\n", i)
+	}
+
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 1)
+
+	c.Check(string(out), Equals, fmt.Sprintf("0\n1\n2\n\n=== %d BYTES ELIDED ===\n8\n999\n", expected.Len()-12))
+
+	c.Assert(r.emissions, HasLen, 3)
+	c.Check(r.emissions[2], DeepEquals, emission{kind: "gauge", name: "testCmd.output_bytes", value: float64(expected.Len()), tags: []string{}})
+
+	// the complete output is saved, and no spill files are left behind
+	files, err := ioutil.ReadDir(logDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Check(files[0].Name(), Equals, fmt.Sprintf("testCmd-%v.out", testCronnerUUID))
+
+	contents, err := ioutil.ReadFile(path.Join(logDir, files[0].Name()))
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, expected.String())
+
+	//
+	// Test that the spill file is removed if the command succeeds
+	//
+	h.uuid = "2b4cd3b8-a1b3-4b43-9d6e-7c9b1e9ce3a4"
+	h.cmd = exec.Command("/bin/echo", "somevalue")
+
+	_, out, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(strings.TrimSpace(string(out)), Equals, "somevalue")
+
+	files, err = ioutil.ReadDir(logDir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 1)
+}
@@ -0,0 +1,299 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With --cgroup the command runs in a transient cgroup v2 of its own, which is
+// created under the --cgroup-parent cgroup for each run and removed once the
+// run is done. Unlike the resource limits, the cgroup's limits and accounting
+// cover everything the command starts, and the OOM killer's kills are counted.
+
+// cgroupCPUPeriod is the period of cpu.max, in microseconds
+const cgroupCPUPeriod = 100000
+
+// cgroupSetting is an interface file of the cgroup to write a limit to, along
+// with the controller the file belongs to
+type cgroupSetting struct {
+	controller string
+	file       string
+	value      string
+}
+
+// cgroupSettings returns the limits to set on the cgroup, from the
+// --cgroup-*-max flags
+func cgroupSettings(opts *binArgs) ([]cgroupSetting, error) {
+	var settings []cgroupSetting
+
+	if len(opts.CgroupMemoryMax) > 0 {
+		value, err := parseLimitValue(opts.CgroupMemoryMax, true)
+		if err != nil {
+			return nil, fmt.Errorf("--cgroup-memory-max value '%v' is invalid, %v", opts.CgroupMemoryMax, err)
+		}
+
+		settings = append(settings, cgroupSetting{"memory", "memory.max", cgroupLimit(value)})
+	}
+
+	if len(opts.CgroupCPUMax) > 0 {
+		cpus, err := strconv.ParseFloat(opts.CgroupCPUMax, 64)
+		if err != nil || cpus <= 0 {
+			return nil, fmt.Errorf("--cgroup-cpu-max value '%v' is invalid, it must be a number of CPUs greater than zero", opts.CgroupCPUMax)
+		}
+
+		// the kernel doesn't allow less than a millisecond per period
+		quota := int64(cpus * cgroupCPUPeriod)
+		if quota < 1000 {
+			quota = 1000
+		}
+
+		settings = append(settings, cgroupSetting{"cpu", "cpu.max", fmt.Sprintf("%d %d", quota, cgroupCPUPeriod)})
+	}
+
+	if opts.CgroupPidsMax > 0 {
+		settings = append(settings, cgroupSetting{"pids", "pids.max", strconv.FormatUint(opts.CgroupPidsMax, 10)})
+	}
+
+	return settings, nil
+}
+
+// cgroupLimit formats a limit for a cgroup interface file
+func cgroupLimit(value uint64) string {
+	if value == rlimitUnlimited {
+		return "max"
+	}
+
+	return strconv.FormatUint(value, 10)
+}
+
+// jobCgroup is the cgroup a run of the command is in
+type jobCgroup struct {
+	dir string
+}
+
+// newJobCgroup creates the cgroup for this run of the command, with the limits
+// from the options. The controllers the limits need are enabled in the parent
+// cgroup, which is created if it doesn't exist.
+func newJobCgroup(hndlr *cmdHandler) (*jobCgroup, error) {
+	settings, err := cgroupSettings(hndlr.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	parent := hndlr.opts.CgroupParent
+
+	if err = os.MkdirAll(parent, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create parent cgroup: %v", err)
+	}
+
+	// the memory controller is wanted for the OOM kills and peak memory
+	// usage too, but it's only needed for --cgroup-memory-max
+	enableCgroupController(parent, "memory")
+
+	for _, s := range settings {
+		if err = enableCgroupController(parent, s.controller); err != nil {
+			return nil, err
+		}
+	}
+
+	cg := &jobCgroup{dir: path.Join(parent, fmt.Sprintf("cronner-%v-%v", hndlr.opts.Label, hndlr.uuid))}
+
+	if err = os.Mkdir(cg.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+
+	for _, s := range settings {
+		if err = ioutil.WriteFile(path.Join(cg.dir, s.file), []byte(s.value), 0644); err != nil {
+			cg.remove()
+			return nil, fmt.Errorf("failed to set %v of cgroup '%v': %v", s.file, cg.dir, err)
+		}
+	}
+
+	return cg, nil
+}
+
+// enableCgroupController enables the controller for the children of the
+// cgroup, if it isn't already
+func enableCgroupController(dir, controller string) error {
+	if hasCgroupController(path.Join(dir, "cgroup.subtree_control"), controller) {
+		return nil
+	}
+
+	// the controllers that can be enabled are the ones the parent enabled
+	controllers := path.Join(dir, "cgroup.controllers")
+
+	if _, err := os.Stat(controllers); err == nil && !hasCgroupController(controllers, controller) {
+		return fmt.Errorf("the %v controller isn't available in cgroup '%v'", controller, dir)
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "cgroup.subtree_control"), []byte("+"+controller), 0644); err != nil {
+		return fmt.Errorf("failed to enable the %v controller in cgroup '%v': %v", controller, dir, err)
+	}
+
+	return nil
+}
+
+// hasCgroupController returns whether the controller is in the list of
+// controllers in the file
+func hasCgroupController(filename, controller string) bool {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+
+	for _, c := range strings.Fields(string(contents)) {
+		if c == controller {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cg *jobCgroup) String() string {
+	return cg.dir
+}
+
+// addProcess moves the process into the cgroup
+func (cg *jobCgroup) addProcess(pid int) error {
+	if err := ioutil.WriteFile(path.Join(cg.dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("failed to move the command into cgroup '%v': %v", cg.dir, err)
+	}
+
+	return nil
+}
+
+// remove removes the cgroup. Anything the command left running in it is
+// killed first, as a cgroup can't be removed while it has processes.
+func (cg *jobCgroup) remove() error {
+	err := os.Remove(cg.dir)
+
+	if err != nil && !os.IsNotExist(err) {
+		if killErr := ioutil.WriteFile(path.Join(cg.dir, "cgroup.kill"), []byte("1"), 0644); killErr == nil {
+			for i := 0; i < 10 && cg.populated(); i++ {
+				time.Sleep(time.Millisecond * 100)
+			}
+
+			err = os.Remove(cg.dir)
+		}
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove cgroup: %v", err)
+	}
+
+	return nil
+}
+
+// populated returns whether there are processes in the cgroup
+func (cg *jobCgroup) populated() bool {
+	events, err := readCgroupKeyed(path.Join(cg.dir, "cgroup.events"))
+	return err == nil && events["populated"] != 0
+}
+
+// readCgroupKeyed reads a cgroup interface file of "<key> <value>" lines
+func readCgroupKeyed(filename string) (map[string]int64, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			values[fields[0]] = n
+		}
+	}
+
+	return values, nil
+}
+
+// cgroupStats is the resource usage of everything that ran in the cgroup, and
+// how many of its processes were killed by the OOM killer; a value that the
+// kernel doesn't report is -1
+type cgroupStats struct {
+	memoryPeak   int64 // bytes
+	cpuUser      time.Duration
+	cpuSystem    time.Duration
+	cpuThrottled time.Duration
+	oomKills     int64
+}
+
+// stats reads the resource usage of the cgroup, which needs to be done before
+// it's removed
+func (cg *jobCgroup) stats() *cgroupStats {
+	s := &cgroupStats{memoryPeak: -1, cpuUser: -1, cpuSystem: -1, cpuThrottled: -1, oomKills: -1}
+
+	if contents, err := ioutil.ReadFile(path.Join(cg.dir, "memory.peak")); err == nil {
+		if n, err := strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64); err == nil {
+			s.memoryPeak = n
+		}
+	}
+
+	if cpu, err := readCgroupKeyed(path.Join(cg.dir, "cpu.stat")); err == nil {
+		usec := func(key string) time.Duration {
+			if n, ok := cpu[key]; ok {
+				return time.Duration(n) * time.Microsecond
+			}
+
+			return -1
+		}
+
+		s.cpuUser, s.cpuSystem, s.cpuThrottled = usec("user_usec"), usec("system_usec"), usec("throttled_usec")
+	}
+
+	if events, err := readCgroupKeyed(path.Join(cg.dir, "memory.events")); err == nil {
+		if n, ok := events["oom_kill"]; ok {
+			s.oomKills = n
+		}
+	}
+
+	return s
+}
+
+// emit sends the cgroup's stats that are known as metrics; the CPU times are
+// timings in milliseconds, like the .time metric
+func (s *cgroupStats) emit(hndlr *cmdHandler, tags []string) {
+	label := hndlr.opts.Label
+
+	if s.memoryPeak >= 0 {
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.cgroup.memory_peak", label), float64(s.memoryPeak), tags)
+	}
+
+	cpu := []struct {
+		name string
+		time time.Duration
+	}{
+		{"user", s.cpuUser},
+		{"system", s.cpuSystem},
+		{"throttled", s.cpuThrottled},
+	}
+
+	for _, c := range cpu {
+		if c.time >= 0 {
+			hndlr.emitter.Timing(fmt.Sprintf("%v.cgroup.cpu.%v", label, c.name), float64(c.time)/float64(time.Millisecond), tags)
+		}
+	}
+
+	if s.oomKills >= 0 {
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.cgroup.oom_kills", label), float64(s.oomKills), tags)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+// The cgroup tests use a directory standing in for the parent cgroup; the
+// interface files that would be there are written by the tests.
+
+func (*TestSuite) Test_cgroupSettings(c *C) {
+	settings, err := cgroupSettings(&binArgs{})
+	c.Assert(err, IsNil)
+	c.Check(settings, HasLen, 0)
+
+	settings, err = cgroupSettings(&binArgs{CgroupMemoryMax: "512M", CgroupCPUMax: "1.5", CgroupPidsMax: 64})
+	c.Assert(err, IsNil)
+	c.Check(settings, DeepEquals, []cgroupSetting{
+		{"memory", "memory.max", "536870912"},
+		{"cpu", "cpu.max", "150000 100000"},
+		{"pids", "pids.max", "64"},
+	})
+
+	settings, err = cgroupSettings(&binArgs{CgroupMemoryMax: "unlimited", CgroupCPUMax: "0.001"})
+	c.Assert(err, IsNil)
+	c.Check(settings, DeepEquals, []cgroupSetting{
+		{"memory", "memory.max", "max"},
+		{"cpu", "cpu.max", "1000 100000"},
+	})
+
+	_, err = cgroupSettings(&binArgs{CgroupMemoryMax: "lots"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--cgroup-memory-max value 'lots' is invalid, it must be a number of bytes, with an optional K, M, G, or T suffix, or unlimited")
+
+	_, err = cgroupSettings(&binArgs{CgroupCPUMax: "0"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--cgroup-cpu-max value '0' is invalid, it must be a number of CPUs greater than zero")
+}
+
+func (*TestSuite) Test_jobCgroup(c *C) {
+	parent := path.Join(c.MkDir(), "cronner")
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter: r,
+		uuid:    testCronnerUUID,
+		opts: &binArgs{
+			Label:           "testCmd",
+			Cgroup:          true,
+			CgroupParent:    parent,
+			CgroupMemoryMax: "1G",
+			CgroupPidsMax:   32,
+		},
+	}
+
+	// the parent is created, and the controllers are enabled in it
+	cg, err := newJobCgroup(h)
+	c.Assert(err, IsNil)
+	c.Check(cg.String(), Equals, path.Join(parent, "cronner-testCmd-"+testCronnerUUID))
+
+	for file, value := range map[string]string{"memory.max": "1073741824", "pids.max": "32"} {
+		contents, err := ioutil.ReadFile(path.Join(cg.dir, file))
+		c.Assert(err, IsNil)
+		c.Check(string(contents), Equals, value)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(parent, "cgroup.subtree_control"))
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "+pids")
+
+	c.Assert(cg.addProcess(1234), IsNil)
+
+	contents, err = ioutil.ReadFile(path.Join(cg.dir, "cgroup.procs"))
+	c.Assert(err, IsNil)
+	c.Check(string(contents), Equals, "1234")
+
+	// nothing is known about the usage until the kernel reports it
+	stats := cg.stats()
+	c.Check(stats, DeepEquals, &cgroupStats{memoryPeak: -1, cpuUser: -1, cpuSystem: -1, cpuThrottled: -1, oomKills: -1})
+
+	stats.emit(h, []string{})
+	c.Check(r.emissions, HasLen, 0)
+
+	c.Assert(ioutil.WriteFile(path.Join(cg.dir, "memory.peak"), []byte("1048576\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(cg.dir, "cpu.stat"), []byte("usage_usec 3500\nuser_usec 2500\nsystem_usec 1000\nnr_periods 0\nthrottled_usec 0\n"), 0644), IsNil)
+	c.Assert(ioutil.WriteFile(path.Join(cg.dir, "memory.events"), []byte("low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n"), 0644), IsNil)
+
+	stats = cg.stats()
+	stats.emit(h, []string{})
+
+	c.Check(r.emissions, DeepEquals, []emission{
+		{kind: "gauge", name: "testCmd.cgroup.memory_peak", value: 1048576, tags: []string{}},
+		{kind: "timing", name: "testCmd.cgroup.cpu.user", value: 2.5, tags: []string{}},
+		{kind: "timing", name: "testCmd.cgroup.cpu.system", value: 1, tags: []string{}},
+		{kind: "timing", name: "testCmd.cgroup.cpu.throttled", value: 0, tags: []string{}},
+		{kind: "gauge", name: "testCmd.cgroup.oom_kills", value: 1, tags: []string{}},
+	})
+
+	// a controller that isn't available
+	c.Assert(ioutil.WriteFile(path.Join(parent, "cgroup.controllers"), []byte("memory pids\n"), 0644), IsNil)
+
+	h.opts.CgroupCPUMax = "1"
+
+	_, err = newJobCgroup(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, fmt.Sprintf("the cpu controller isn't available in cgroup '%v'", parent))
+}
+
+func (*TestSuite) Test_handleCommand_cgroup(c *C) {
+	parent := c.MkDir()
+	dir := path.Join(parent, "cronner-testCmd-"+testCronnerUUID)
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:        "testCmd",
+			FailEvent:    true,
+			Cgroup:       true,
+			CgroupParent: parent,
+		},
+		cmd: exec.Command("/bin/sh", "-c", fmt.Sprintf("cat %v/cgroup.procs", dir)),
+	}
+
+	// the command is only run once it's been moved into its cgroup
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, strconv.Itoa(h.cmd.Process.Pid))
+	c.Check(h.cgroup, IsNil)
+
+	// the directory standing in for the cgroup can't be removed like a cgroup
+	c.Assert(os.RemoveAll(dir), IsNil)
+
+	// being killed by the OOM killer
+	r.emissions = nil
+	h.cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf(`printf "oom_kill 1\n" > %v/memory.events; exit 137`, dir))
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 137)
+
+	var event emission
+
+	for _, e := range r.emissions {
+		if e.kind == "event" {
+			event = e
+		}
+	}
+
+	c.Check(strings.HasPrefix(event.name, "Cron testCmd failed (out of memory) in "), Equals, true, Commentf("title: %q", event.name))
+	c.Check(strings.Contains(event.body, "\nout of memory: the OOM killer killed 1 processes in the command's cgroup\n"), Equals, true, Commentf("body: %q", event.body))
+}
+
+func (*TestSuite) Test_waitReady(c *C) {
+	for _, write := range []bool{true, false} {
+		r, w, err := os.Pipe()
+		c.Assert(err, IsNil)
+
+		if write {
+			w.Write([]byte{1})
+		}
+
+		w.Close()
+
+		// waitReady closes the file descriptor it's given
+		fd, err := syscall.Dup(int(r.Fd()))
+		c.Assert(err, IsNil)
+		r.Close()
+
+		c.Check(waitReady(fd), Equals, write)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/pelletier/go-toml"
+)
+
+// The job config file is TOML, with a [defaults] table, and a [jobs.<name>]
+// table for each job. The keys are the long names of the command line flags,
+// plus "command" for the command to run. The values can be strings, numbers,
+// booleans, or arrays of strings:
+//
+//	[defaults]
+//	lock = true
+//	event-fail = true
+//	tag = ["team:infra"]
+//
+//	[jobs.nightly_backup]
+//	command = ["/usr/local/bin/backup", "--full"]
+//	timeout = 3600
+
+const (
+	configDefaultsTable = "defaults"
+	configJobsTable     = "jobs"
+)
+
+// configErrorRegex matches the position at the start of the TOML parser's
+// errors
+var configErrorRegex = regexp.MustCompile(`^\((\d+), \d+\): (.*)$`)
+
+// configValue is a value from the config file, along with the line it's on;
+// the value is a string, int64, float64, bool, or []interface{} of those, as
+// the TOML parser returns them
+type configValue struct {
+	line  int
+	value interface{}
+}
+
+// configTable is the key/value pairs of a table in the config file
+type configTable map[string]configValue
+
+// jobConfig is a parsed config file
+type jobConfig struct {
+	filename string
+	defaults configTable
+	jobs     map[string]configTable
+
+	// jobLines is the line each job's table starts on
+	jobLines map[string]int
+}
+
+// configError is an error in the config file, at a specific line if line is
+// greater than zero
+type configError struct {
+	filename string
+	line     int
+	msg      string
+}
+
+func (e *configError) Error() string {
+	if e.line > 0 {
+		return fmt.Sprintf("config file '%v' line %d: %v", e.filename, e.line, e.msg)
+	}
+
+	return fmt.Sprintf("config file '%v': %v", e.filename, e.msg)
+}
+
+// loadConfig reads and parses the config file
+func loadConfig(filename string) (*jobConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+
+	defer file.Close()
+
+	return parseConfig(filename, file)
+}
+
+// parseConfig parses the config file read from r; filename is only used in
+// the error messages
+func parseConfig(filename string, r io.Reader) (*jobConfig, error) {
+	tree, err := toml.LoadReader(r)
+	if err != nil {
+		if m := configErrorRegex.FindStringSubmatch(err.Error()); m != nil {
+			line, _ := strconv.Atoi(m[1])
+			return nil, &configError{filename, line, m[2]}
+		}
+
+		return nil, &configError{filename, 0, err.Error()}
+	}
+
+	cfg := &jobConfig{
+		filename: filename,
+		defaults: configTable{},
+		jobs:     make(map[string]configTable),
+		jobLines: make(map[string]int),
+	}
+
+	for _, key := range tree.Keys() {
+		line := tree.GetPosition(key).Line
+
+		switch key {
+		case configDefaultsTable:
+			defaults, ok := tree.Get(key).(*toml.Tree)
+			if !ok {
+				return nil, &configError{filename, line, fmt.Sprintf("%v must be a table", key)}
+			}
+
+			cfg.defaults = newConfigTable(defaults)
+		case configJobsTable:
+			jobs, ok := tree.Get(key).(*toml.Tree)
+			if !ok {
+				return nil, &configError{filename, line, fmt.Sprintf("%v must be a table", key)}
+			}
+
+			for _, job := range jobs.Keys() {
+				table, ok := jobs.Get(job).(*toml.Tree)
+				if !ok {
+					return nil, &configError{filename, jobs.GetPosition(job).Line, fmt.Sprintf("job '%v' must be a table", job)}
+				}
+
+				cfg.jobs[job] = newConfigTable(table)
+				cfg.jobLines[job] = jobs.GetPosition(job).Line
+			}
+		default:
+			return nil, &configError{filename, line, fmt.Sprintf("unknown key '%v', it must be in the [defaults] or a [jobs.<name>] table", key)}
+		}
+	}
+
+	return cfg, nil
+}
+
+// newConfigTable returns the key/value pairs of the TOML table
+func newConfigTable(tree *toml.Tree) configTable {
+	table := configTable{}
+
+	for _, key := range tree.Keys() {
+		table[key] = configValue{line: tree.GetPosition(key).Line, value: tree.Get(key)}
+	}
+
+	return table
+}
+
+// configOptions returns the kind of each of the flags, keyed by long name,
+// that can be set in the config file
+func configOptions() map[string]reflect.Kind {
+	options := make(map[string]reflect.Kind)
+
+	t := reflect.TypeOf(binArgs{})
+
+	for i := 0; i < t.NumField(); i++ {
+		if long := t.Field(i).Tag.Get("long"); len(long) > 0 {
+			options[long] = t.Field(i).Type.Kind()
+		}
+	}
+
+	// these only make sense on the command line
+	delete(options, "config")
+	delete(options, "job")
+	delete(options, "version")
+
+	return options
+}
+
+// configOption is the command line arguments equivalent to one of the settings
+// of a job, and the line the setting is on
+type configOption struct {
+	line int
+	args []string
+}
+
+// jobArgs returns the command line arguments equivalent to the settings of the
+// job, with its table merged over the defaults, and the command to run. The
+// label defaults to the name of the job.
+func (c *jobConfig) jobArgs(job string) ([]string, []string, error) {
+	options, command, err := c.jobOptions(job)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var args []string
+
+	for _, option := range options {
+		args = append(args, option.args...)
+	}
+
+	return args, command, nil
+}
+
+// jobOptions returns the settings of the job like jobArgs does, but as the
+// arguments of each setting along with the line it's on
+func (c *jobConfig) jobOptions(job string) ([]configOption, []string, error) {
+	table, ok := c.jobs[job]
+	if !ok {
+		return nil, nil, &configError{c.filename, 0, fmt.Sprintf("job '%v' is not defined", job)}
+	}
+
+	merged := configTable{}
+
+	for key, value := range c.defaults {
+		merged[key] = value
+	}
+
+	for key, value := range table {
+		merged[key] = value
+	}
+
+	if _, ok := merged["label"]; !ok {
+		merged["label"] = configValue{line: c.jobLines[job], value: job}
+	}
+
+	keys := make([]string, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	kinds := configOptions()
+
+	var options []configOption
+	var command []string
+
+	for _, key := range keys {
+		value := merged[key]
+
+		if key == "command" {
+			var err error
+			if command, err = configStrings(value.value); err != nil {
+				return nil, nil, &configError{c.filename, value.line, fmt.Sprintf("command %v", err)}
+			}
+			continue
+		}
+
+		kind, ok := kinds[key]
+		if !ok {
+			return nil, nil, &configError{c.filename, value.line, fmt.Sprintf("unknown option '%v'", key)}
+		}
+
+		option := configOption{line: value.line}
+
+		switch kind {
+		case reflect.Bool:
+			b, ok := value.value.(bool)
+			if !ok {
+				return nil, nil, &configError{c.filename, value.line, fmt.Sprintf("option '%v' must be true or false", key)}
+			}
+
+			if b {
+				option.args = append(option.args, "--"+key)
+			}
+		case reflect.Slice:
+			values, err := configStrings(value.value)
+			if err != nil {
+				return nil, nil, &configError{c.filename, value.line, fmt.Sprintf("option '%v' %v", key, err)}
+			}
+
+			for _, v := range values {
+				option.args = append(option.args, fmt.Sprintf("--%v=%v", key, v))
+			}
+		default:
+			switch v := value.value.(type) {
+			case string, int64:
+				option.args = append(option.args, fmt.Sprintf("--%v=%v", key, v))
+			case float64:
+				option.args = append(option.args, fmt.Sprintf("--%v=%v", key, strconv.FormatFloat(v, 'f', -1, 64)))
+			default:
+				return nil, nil, &configError{c.filename, value.line, fmt.Sprintf("option '%v' must be a string or a number", key)}
+			}
+		}
+
+		options = append(options, option)
+	}
+
+	return options, command, nil
+}
+
+// configStrings converts a string, or an array of strings, to a []string
+func configStrings(value interface{}) ([]string, error) {
+	switch v := value.(type) {
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		values := make([]string, len(v))
+
+		for i, elem := range v {
+			s, ok := elem.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a string or an array of strings")
+			}
+
+			values[i] = s
+		}
+
+		return values, nil
+	default:
+		return nil, fmt.Errorf("must be a string or an array of strings")
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/tideland/golib/logger"
+	. "gopkg.in/check.v1"
+)
+
+const testConfig = `# cronner jobs
+[defaults]
+lock = true
+event-fail = true
+tag = ["team:infra", 'env:prod']   # shared tags
+lock-dir = "/var/testlock"
+
+[jobs.nightly_backup]
+command = ["/bin/sh", "-c", "echo \"backing up\""]
+timeout = 3600
+group = "backups"
+
+[jobs.unlocked]
+label = "Not Locked"
+command = "/bin/true"
+lock = false
+tag = []
+
+[jobs."heavy report"]
+command = [
+  "/usr/local/bin/report",
+  "--all",  # every region
+]
+cgroup = true
+cgroup-cpu-max = 1.5
+`
+
+func (*TestSuite) Test_parseConfig(c *C) {
+	cfg, err := parseConfig("jobs.toml", strings.NewReader(testConfig))
+	c.Assert(err, IsNil)
+
+	c.Check(cfg.defaults["lock"], Equals, configValue{line: 3, value: true})
+	c.Check(cfg.defaults["tag"].value, DeepEquals, []interface{}{"team:infra", "env:prod"})
+	c.Check(cfg.defaults["lock-dir"].value, Equals, "/var/testlock")
+
+	c.Assert(cfg.jobs, HasLen, 3)
+	c.Check(cfg.jobs["nightly_backup"]["command"].value, DeepEquals, []interface{}{"/bin/sh", "-c", `echo "backing up"`})
+	c.Check(cfg.jobs["nightly_backup"]["timeout"].value, Equals, int64(3600))
+	c.Check(cfg.jobLines["nightly_backup"], Equals, 8)
+
+	args, command, err := cfg.jobArgs("nightly_backup")
+	c.Assert(err, IsNil)
+	c.Check(command, DeepEquals, []string{"/bin/sh", "-c", `echo "backing up"`})
+	c.Check(args, DeepEquals, []string{
+		"--event-fail",
+		"--group=backups",
+		"--label=nightly_backup",
+		"--lock",
+		"--lock-dir=/var/testlock",
+		"--tag=team:infra",
+		"--tag=env:prod",
+		"--timeout=3600",
+	})
+
+	// the job's settings replace the defaults
+	args, command, err = cfg.jobArgs("unlocked")
+	c.Assert(err, IsNil)
+	c.Check(command, DeepEquals, []string{"/bin/true"})
+	c.Check(args, DeepEquals, []string{
+		"--event-fail",
+		"--label=Not Locked",
+		"--lock-dir=/var/testlock",
+	})
+
+	// quoted table names, multi-line arrays, and floats are TOML too
+	args, command, err = cfg.jobArgs("heavy report")
+	c.Assert(err, IsNil)
+	c.Check(command, DeepEquals, []string{"/usr/local/bin/report", "--all"})
+	c.Check(args, DeepEquals, []string{
+		"--cgroup",
+		"--cgroup-cpu-max=1.5",
+		"--event-fail",
+		"--label=heavy report",
+		"--lock",
+		"--lock-dir=/var/testlock",
+		"--tag=team:infra",
+		"--tag=env:prod",
+	})
+	c.Check(cfg.jobLines["heavy report"], Equals, 19)
+
+	_, _, err = cfg.jobArgs("missing")
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "config file 'jobs.toml': job 'missing' is not defined")
+}
+
+func (*TestSuite) Test_parseConfig_errors(c *C) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{"lock = true", "config file 'jobs.toml' line 1: unknown key 'lock', it must be in the [defaults] or a [jobs.<name>] table"},
+		{"[other]\nlock = true", "config file 'jobs.toml' line 1: unknown key 'other', it must be in the [defaults] or a [jobs.<name>] table"},
+		{"jobs = 1", "config file 'jobs.toml' line 1: jobs must be a table"},
+		{"[jobs]\na = 1", "config file 'jobs.toml' line 2: job 'a' must be a table"},
+		{"[jobs.a]\n[jobs.a]", "config file 'jobs.toml' line 2: duplicated tables"},
+		{"[defaults]\nlock = true\nlock = false", "config file 'jobs.toml' line 3: The following key was defined twice: defaults.lock"},
+		{"[defaults]\nlabel = \"abc", "config file 'jobs.toml' line 2: unclosed string"},
+		{"[defaults]\ntag = [\"a\",\n  \"b\"", "config file 'jobs.toml' line 3: unterminated array"},
+	}
+
+	for _, test := range tests {
+		_, err := parseConfig("jobs.toml", strings.NewReader(test.config))
+		c.Assert(err, Not(IsNil), Commentf("config: %q", test.config))
+		c.Check(err.Error(), Equals, test.err)
+	}
+
+	jobTests := []struct {
+		config string
+		err    string
+	}{
+		{"[jobs.a]\nbogus = 1", "config file 'jobs.toml' line 2: unknown option 'bogus'"},
+		{"[jobs.a]\nversion = true", "config file 'jobs.toml' line 2: unknown option 'version'"},
+		{"[jobs.a]\nlock = 1", "config file 'jobs.toml' line 2: option 'lock' must be true or false"},
+		{"[jobs.a]\ntag = [1]", "config file 'jobs.toml' line 2: option 'tag' must be a string or an array of strings"},
+		{"[jobs.a]\ntimeout = [1]", "config file 'jobs.toml' line 2: option 'timeout' must be a string or a number"},
+		{"[jobs.a]\ncommand = true", "config file 'jobs.toml' line 2: command must be a string or an array of strings"},
+	}
+
+	for _, test := range jobTests {
+		cfg, err := parseConfig("jobs.toml", strings.NewReader(test.config))
+		c.Assert(err, IsNil)
+
+		_, _, err = cfg.jobArgs("a")
+		c.Assert(err, Not(IsNil), Commentf("config: %q", test.config))
+		c.Check(err.Error(), Equals, test.err)
+	}
+}
+
+func (*TestSuite) Test_binArgs_parse_config(c *C) {
+	const Arg0 = "/usr/loca/bin/cronner"
+
+	filename := path.Join(c.MkDir(), "jobs.toml")
+	c.Assert(ioutil.WriteFile(filename, []byte(testConfig), 0644), IsNil)
+
+	args := &binArgs{}
+	output, err := args.parse([]string{Arg0, "--config", filename, "--job", "nightly_backup"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "")
+
+	c.Check(args.Label, Equals, "nightly_backup")
+	c.Check(args.Lock, Equals, true)
+	c.Check(args.LockDir, Equals, "/var/testlock")
+	c.Check(args.FailEvent, Equals, true)
+	c.Check(args.Group, Equals, "backups")
+	c.Check(args.Tags, DeepEquals, []string{"team:infra", "env:prod"})
+	c.Check(args.Timeout, Equals, uint64(3600))
+	c.Check(args.Cmd, Equals, "/bin/sh")
+	c.Check(args.CmdArgs, DeepEquals, []string{"-c", `echo "backing up"`})
+
+	// the defaults of the flags not in the file still apply
+	c.Check(args.LogPath, Equals, "/var/log/cronner")
+	c.Check(args.Namespace, Equals, "cronner")
+
+	// the command line overrides the file
+	args = &binArgs{}
+	_, err = args.parse([]string{
+		Arg0,
+		"--config", filename,
+		"--job", "nightly_backup",
+		"--timeout", "60",
+		"--label", "other",
+		"--log-level", "info",
+		"--", "/bin/echo", "hi",
+	})
+	c.Assert(err, IsNil)
+	logger.SetLevel(logger.LevelFatal)
+
+	c.Check(args.Label, Equals, "other")
+	c.Check(args.Timeout, Equals, uint64(60))
+	c.Check(args.Cmd, Equals, "/bin/echo")
+	c.Check(args.CmdArgs, DeepEquals, []string{"hi"})
+
+	// the label from the file is validated like any other
+	args = &binArgs{}
+	_, err = args.parse([]string{Arg0, "--config", filename, "--job", "unlocked"})
+	c.Assert(err, IsNil)
+	c.Check(args.Label, Equals, "not_locked")
+	c.Check(args.Lock, Equals, false)
+
+	c.Assert(ioutil.WriteFile(filename, []byte("[jobs.bad]\nlabel = \"bad!\"\ncommand = \"/bin/true\"\n"), 0644), IsNil)
+
+	args = &binArgs{}
+	_, err = args.parse([]string{Arg0, "--config", filename, "--job", "bad"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "cron label 'bad!' is invalid, it can only be alphanumeric with underscores, periods, and spaces")
+
+	// --config and --job go together
+	args = &binArgs{}
+	_, err = args.parse([]string{Arg0, "--config", filename, "--", "/bin/true"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--config requires --job to select the job to run")
+
+	args = &binArgs{}
+	_, err = args.parse([]string{Arg0, "--job", "bad", "--", "/bin/true"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--job can only be used with --config")
+
+	args = &binArgs{}
+	_, err = args.parse([]string{Arg0, "--config", path.Join(path.Dir(filename), "missing.toml"), "--job", "bad"})
+	c.Assert(err, Not(IsNil))
+	c.Check(strings.HasPrefix(err.Error(), "failed to open config file:"), Equals, true)
+}
@@ -0,0 +1,200 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// resolveCredential looks up the --user, --user-group, and
+// --supplementary-groups to run the command as. It returns nil if none of them
+// were given, so that the command runs as cronner does.
+//
+// The group defaults to the user's primary group, and the supplementary groups
+// default to the groups the user is a member of. Without --user, the command
+// keeps cronner's user and supplementary groups.
+func resolveCredential(opts *binArgs) (*syscall.Credential, error) {
+	if len(opts.User) == 0 && len(opts.UserGroup) == 0 && len(opts.SuppGroups) == 0 {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	}
+
+	var groups []string
+
+	if len(opts.User) > 0 {
+		u, err := lookupUser(opts.User)
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := parseID(u.Uid)
+		if err != nil {
+			return nil, fmt.Errorf("user '%v' has an invalid uid: %v", opts.User, err)
+		}
+
+		gid, err := parseID(u.Gid)
+		if err != nil {
+			return nil, fmt.Errorf("user '%v' has an invalid gid: %v", opts.User, err)
+		}
+
+		cred.Uid, cred.Gid = uid, gid
+
+		if groups, err = u.GroupIds(); err != nil {
+			return nil, fmt.Errorf("failed to look up the groups of user '%v': %v", opts.User, err)
+		}
+	} else {
+		gids, err := os.Getgroups()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the supplementary groups: %v", err)
+		}
+
+		for _, gid := range gids {
+			groups = append(groups, strconv.Itoa(gid))
+		}
+	}
+
+	if len(opts.UserGroup) > 0 {
+		gid, err := lookupGroup(opts.UserGroup)
+		if err != nil {
+			return nil, err
+		}
+
+		cred.Gid = gid
+	}
+
+	if len(opts.SuppGroups) > 0 {
+		groups = strings.Split(opts.SuppGroups, ",")
+	}
+
+	for _, group := range groups {
+		gid, err := lookupGroup(strings.TrimSpace(group))
+		if err != nil {
+			return nil, err
+		}
+
+		cred.Groups = append(cred.Groups, gid)
+	}
+
+	return cred, nil
+}
+
+// lookupUser looks up a user by name, or by uid if name is numeric
+func lookupUser(name string) (*user.User, error) {
+	var u *user.User
+	var err error
+
+	if _, idErr := parseID(name); idErr == nil {
+		u, err = user.LookupId(name)
+	} else {
+		u, err = user.Lookup(name)
+	}
+
+	switch err.(type) {
+	case nil:
+		return u, nil
+	case user.UnknownUserError, user.UnknownUserIdError:
+		return nil, fmt.Errorf("user '%v' does not exist", name)
+	default:
+		return nil, fmt.Errorf("failed to look up user '%v': %v", name, err)
+	}
+}
+
+// lookupGroup looks up a group by name, or by gid if name is numeric, and
+// returns its gid
+func lookupGroup(name string) (uint32, error) {
+	var g *user.Group
+	var err error
+
+	if _, idErr := parseID(name); idErr == nil {
+		g, err = user.LookupGroupId(name)
+	} else {
+		g, err = user.LookupGroup(name)
+	}
+
+	switch err.(type) {
+	case nil:
+	case user.UnknownGroupError, user.UnknownGroupIdError:
+		return 0, fmt.Errorf("group '%v' does not exist", name)
+	default:
+		return 0, fmt.Errorf("failed to look up group '%v': %v", name, err)
+	}
+
+	gid, err := parseID(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("group '%v' has an invalid gid: %v", name, err)
+	}
+
+	return gid, nil
+}
+
+// parseID parses a uid or gid
+func parseID(id string) (uint32, error) {
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint32(n), nil
+}
+
+// commandCredential returns who the command runs as, or nil if it runs as
+// cronner does
+func commandCredential(hndlr *cmdHandler) *syscall.Credential {
+	if hndlr.cmd.SysProcAttr == nil {
+		return nil
+	}
+
+	return hndlr.cmd.SysProcAttr.Credential
+}
+
+// chownToCommand makes the file owned by who the command runs as, if it runs
+// as someone else, so that the files cronner leaves behind for the job belong
+// to its user
+func chownToCommand(hndlr *cmdHandler, filename string) error {
+	cred := commandCredential(hndlr)
+	if cred == nil {
+		return nil
+	}
+
+	if err := os.Chown(filename, int(cred.Uid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to change the owner of '%v' to %d:%d: %v", filename, cred.Uid, cred.Gid, err)
+	}
+
+	return nil
+}
+
+// setCredential switches the calling process to the credential, for the exec
+// helper; the user is switched to last, as it takes the privileges needed to
+// set the groups with it
+func setCredential(cred *syscall.Credential) error {
+	groups := make([]int, len(cred.Groups))
+
+	for i, gid := range cred.Groups {
+		groups[i] = int(gid)
+	}
+
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set the supplementary groups: %v", err)
+	}
+
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("failed to set the group to %d: %v", cred.Gid, err)
+	}
+
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("failed to set the user to %d: %v", cred.Uid, err)
+	}
+
+	return nil
+}
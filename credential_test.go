@@ -0,0 +1,166 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_resolveCredential(c *C) {
+	current, err := user.Current()
+	c.Assert(err, IsNil)
+
+	uid, err := strconv.Atoi(current.Uid)
+	c.Assert(err, IsNil)
+
+	gid, err := strconv.Atoi(current.Gid)
+	c.Assert(err, IsNil)
+
+	// nothing given
+	cred, err := resolveCredential(&binArgs{})
+	c.Assert(err, IsNil)
+	c.Check(cred, IsNil)
+
+	// by name and by uid, defaulting to the user's groups
+	for _, name := range []string{current.Username, current.Uid} {
+		cred, err = resolveCredential(&binArgs{User: name})
+		c.Assert(err, IsNil)
+		c.Check(cred.Uid, Equals, uint32(uid))
+		c.Check(cred.Gid, Equals, uint32(gid))
+		c.Check(len(cred.Groups) > 0, Equals, true)
+	}
+
+	// overriding the groups
+	cred, err = resolveCredential(&binArgs{User: current.Username, UserGroup: current.Gid, SuppGroups: current.Gid + ", " + current.Gid})
+	c.Assert(err, IsNil)
+	c.Check(cred.Gid, Equals, uint32(gid))
+	c.Check(cred.Groups, DeepEquals, []uint32{uint32(gid), uint32(gid)})
+
+	// just the group, keeping the user
+	cred, err = resolveCredential(&binArgs{UserGroup: current.Gid})
+	c.Assert(err, IsNil)
+	c.Check(cred.Uid, Equals, uint32(os.Getuid()))
+	c.Check(cred.Gid, Equals, uint32(gid))
+
+	// things that don't exist
+	_, err = resolveCredential(&binArgs{User: "cronner-no-such-user"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "user 'cronner-no-such-user' does not exist")
+
+	_, err = resolveCredential(&binArgs{User: current.Username, UserGroup: "cronner-no-such-group"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "group 'cronner-no-such-group' does not exist")
+
+	_, err = resolveCredential(&binArgs{User: current.Username, SuppGroups: current.Gid + ",cronner-no-such-group"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "group 'cronner-no-such-group' does not exist")
+}
+
+func (*TestSuite) Test_handleCommand_user(c *C) {
+	lockDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter: &recordingEmitter{},
+		uuid:    testCronnerUUID,
+		opts: &binArgs{
+			Label:   "testCmd",
+			LockDir: lockDir,
+			Lock:    true,
+			User:    "cronner-no-such-user",
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	// the user is checked before the lock is taken
+	retCode, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 200)
+	c.Check(err.Error(), Equals, "user 'cronner-no-such-user' does not exist")
+
+	files, err := ioutil.ReadDir(lockDir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 0)
+
+	if os.Getuid() != 0 {
+		c.Skip("running the command as another user needs root")
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		c.Skip("there is no nobody user")
+	}
+
+	logDir := c.MkDir()
+
+	h.opts.User = "nobody"
+	h.opts.LogFail = true
+	h.opts.LogPath = logDir
+	h.opts.LockBackend = lockBackendFlock
+	h.cmd = exec.Command("/bin/sh", "-c", "id -u; id -g; exit 1")
+
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 1)
+	c.Check(string(out), Equals, nobody.Uid+"\n"+nobody.Gid+"\n")
+
+	// the lock and log files are handed over to the user
+	owner := func(filename string) string {
+		stat, err := os.Stat(filename)
+		c.Assert(err, IsNil)
+
+		sys := stat.Sys().(*syscall.Stat_t)
+		return strconv.Itoa(int(sys.Uid)) + ":" + strconv.Itoa(int(sys.Gid))
+	}
+
+	c.Check(owner(path.Join(lockDir, "cronner-testCmd.lock")), Equals, nobody.Uid+":"+nobody.Gid)
+
+	files, err = ioutil.ReadDir(logDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Check(owner(path.Join(logDir, files[0].Name())), Equals, nobody.Uid+":"+nobody.Gid)
+}
+
+func (*TestSuite) Test_handleCommand_userPrivileged(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("running the command as another user needs root")
+	}
+
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		c.Skip("there is no nobody user")
+	}
+
+	limits, err := parseRlimits(&binArgs{LimitNofile: "64"})
+	c.Assert(err, IsNil)
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			FailEvent: true,
+			User:      "nobody",
+			Nice:      -5,
+			Limits:    limits,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "id -u; id -g; nice; ulimit -n"),
+	}
+
+	// what needs root is set up before the command's user is switched to
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, nobody.Uid+"\n"+nobody.Gid+"\n-5\n64\n")
+	c.Check(h.cmd.SysProcAttr.Credential, Not(IsNil))
+}
@@ -8,6 +8,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
@@ -21,13 +22,26 @@ import (
 const Version = "1.0.0"
 
 type cmdHandler struct {
-	gs               *godspeed.Godspeed
+	emitter          Emitter
+	notifiers        []notifier
 	opts             *binArgs
 	cmd              *exec.Cmd
 	uuid             string
 	hostname         string
 	parentEventTags  []string
 	parentMetricTags []string
+
+	// cgroup is the cgroup the command runs in with --cgroup, while it's
+	// running
+	cgroup *jobCgroup
+}
+
+// subcommands are run instead of a command when their name is the first
+// argument; each one gets the rest of the arguments, and returns the exit code
+var subcommands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"history":  historyCmd,
+	"locks":    locksCmd,
+	"validate": validateCmd,
 }
 
 var cronnerEventEnvVars = []string{
@@ -79,6 +93,16 @@ func parseEnvForParent() (eventTags, metricTags []string) {
 func main() {
 	logger.SetLogger(logger.NewStandardLogger(os.Stderr))
 
+	if len(os.Args) > 1 {
+		if os.Args[1] == execHelperArg {
+			os.Exit(execHelper(os.Args[2:], os.Stderr))
+		}
+
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(subcommand(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	// get and parse the command line options
 	opts := &binArgs{}
 	output, err := opts.parse(nil)
@@ -95,21 +119,27 @@ func main() {
 		os.Exit(0)
 	}
 
-	// build a Godspeed client
-	var gs *godspeed.Godspeed
-	if opts.StatsdHost == "" {
-		gs, err = godspeed.NewDefault()
-	} else {
-		gs, err = godspeed.New(opts.StatsdHost, godspeed.DefaultPort, false)
-	}
+	var emitters []Emitter
 
-	// make sure nothing went wrong with Godspeed
-	if err != nil {
-		logger.Errorf("error: %v\n", err)
-		os.Exit(1)
-	}
+	// build a Godspeed client, unless statsd was turned off
+	if !opts.NoStatsd {
+		var gs *godspeed.Godspeed
+		if opts.StatsdHost == "" {
+			gs, err = godspeed.NewDefault()
+		} else {
+			gs, err = godspeed.New(opts.StatsdHost, godspeed.DefaultPort, false)
+		}
 
-	gs.SetNamespace(opts.Namespace)
+		// make sure nothing went wrong with Godspeed
+		if err != nil {
+			logger.Errorf("error: %v\n", err)
+			os.Exit(1)
+		}
+
+		gs.SetNamespace(opts.Namespace)
+
+		emitters = append(emitters, gs)
+	}
 
 	// get the hostname and validate nothing happened
 	hostname, err := os.Hostname()
@@ -120,11 +150,12 @@ func main() {
 	}
 
 	handler := &cmdHandler{
-		opts:     opts,
-		hostname: hostname,
-		gs:       gs,
-		uuid:     uuid.New(),
-		cmd:      exec.Command(opts.Cmd, opts.CmdArgs...),
+		opts:      opts,
+		hostname:  hostname,
+		emitter:   newMultiEmitter(emitters...),
+		notifiers: newNotifiers(opts),
+		uuid:      uuid.New(),
+		cmd:       exec.Command(opts.Cmd, opts.CmdArgs...),
 	}
 
 	handler.parentEventTags, handler.parentMetricTags = parseEnvForParent()
@@ -132,7 +163,7 @@ func main() {
 	ret, _, _, err := handleCommand(handler)
 
 	if err != nil {
-		logger.Errorf(err.Error())
+		logger.Errorf("%v", err)
 	}
 
 	os.Exit(ret)
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"path"
 	"strconv"
 	"testing"
@@ -23,7 +24,17 @@ const testCronnerUUID = "02a10ce3-e834-4285-b1ad-272460541f08"
 
 func Test(t *testing.T) { TestingT(t) }
 
+func TestMain(m *testing.M) {
+	// the test binary stands in for cronner when the exec helper is started
+	if len(os.Args) > 1 && os.Args[1] == execHelperArg {
+		os.Exit(execHelper(os.Args[2:], os.Stderr))
+	}
+
+	os.Exit(m.Run())
+}
+
 type TestSuite struct {
+	gs       *godspeed.Godspeed
 	l        *net.UDPConn
 	ctrl     chan int
 	out      chan []byte
@@ -53,10 +64,6 @@ func (t *TestSuite) SetUpSuite(c *C) {
 	t.lockFile = path.Join(t.h.opts.LockDir, "cronner-testCmd.lock")
 }
 
-func (t *TestSuite) TearDownSuite(c *C) {
-	t.h.gs.Conn.Close()
-}
-
 func addrStrToHostPort(addr string) (string, int, error) {
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -86,10 +93,12 @@ func (t *TestSuite) SetUpTest(c *C) {
 	c.Assert(err, IsNil)
 
 	gs.SetNamespace("cronner")
-	t.h.gs = gs
+	t.gs = gs
+	t.h.emitter = gs
 }
 
 func (t *TestSuite) TearDownTest(c *C) {
+	t.gs.Conn.Close()
 	close(t.ctrl)
 	t.l.Close()
 }
@@ -0,0 +1,90 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import "github.com/PagerDuty/godspeed"
+
+// Emitter is the interface for the backends cronner sends its metrics, events,
+// and service checks to. The method signatures match those of the Godspeed
+// DogStatsD client, so a *godspeed.Godspeed can be used as an Emitter as-is.
+type Emitter interface {
+	// Timing emits a timing metric, with the value in milliseconds
+	Timing(stat string, value float64, tags []string) error
+
+	// Gauge emits a gauge metric
+	Gauge(stat string, value float64, tags []string) error
+
+	// Count emits a counter metric, incremented by count
+	Count(stat string, count float64, tags []string) error
+
+	// Event emits an event; the fields are the DogStatsD event fields, such
+	// as alert_type and aggregation_key
+	Event(title, body string, fields map[string]string, tags []string) error
+
+	// ServiceCheck emits the status of a service check, using the DogStatsD
+	// status values (OK = 0, WARNING = 1, CRITICAL = 2, UNKNOWN = 3)
+	ServiceCheck(name string, status int, fields map[string]string, tags []string) error
+}
+
+// make sure Godspeed stays usable as an Emitter
+var _ Emitter = (*godspeed.Godspeed)(nil)
+
+// noopEmitter is an Emitter that discards everything
+type noopEmitter struct{}
+
+func (noopEmitter) Timing(string, float64, []string) error                      { return nil }
+func (noopEmitter) Gauge(string, float64, []string) error                       { return nil }
+func (noopEmitter) Count(string, float64, []string) error                       { return nil }
+func (noopEmitter) Event(string, string, map[string]string, []string) error     { return nil }
+func (noopEmitter) ServiceCheck(string, int, map[string]string, []string) error { return nil }
+
+// multiEmitter is an Emitter that fans out everything to multiple Emitters. All
+// of the Emitters are always called, and the first error (if any) is returned.
+type multiEmitter []Emitter
+
+// newMultiEmitter returns an Emitter that sends to all of the emitters given,
+// a noopEmitter if there are none, or the only one if there's only one
+func newMultiEmitter(emitters ...Emitter) Emitter {
+	switch len(emitters) {
+	case 0:
+		return noopEmitter{}
+	case 1:
+		return emitters[0]
+	default:
+		return multiEmitter(emitters)
+	}
+}
+
+func (m multiEmitter) each(fn func(Emitter) error) error {
+	var retErr error
+
+	for _, e := range m {
+		if err := fn(e); err != nil && retErr == nil {
+			retErr = err
+		}
+	}
+
+	return retErr
+}
+
+func (m multiEmitter) Timing(stat string, value float64, tags []string) error {
+	return m.each(func(e Emitter) error { return e.Timing(stat, value, tags) })
+}
+
+func (m multiEmitter) Gauge(stat string, value float64, tags []string) error {
+	return m.each(func(e Emitter) error { return e.Gauge(stat, value, tags) })
+}
+
+func (m multiEmitter) Count(stat string, count float64, tags []string) error {
+	return m.each(func(e Emitter) error { return e.Count(stat, count, tags) })
+}
+
+func (m multiEmitter) Event(title, body string, fields map[string]string, tags []string) error {
+	return m.each(func(e Emitter) error { return e.Event(title, body, fields, tags) })
+}
+
+func (m multiEmitter) ServiceCheck(name string, status int, fields map[string]string, tags []string) error {
+	return m.each(func(e Emitter) error { return e.ServiceCheck(name, status, fields, tags) })
+}
@@ -0,0 +1,127 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+// emission is a single metric, event, or service check that was recorded
+type emission struct {
+	kind  string // timing, gauge, count, event, or service_check
+	name  string // the stat or service check name, or the event title
+	value float64
+	body  string
+	tags  []string
+}
+
+// recordingEmitter is an in-memory Emitter used for testing
+type recordingEmitter struct {
+	mu        sync.Mutex
+	emissions []emission
+	err       error
+}
+
+func (r *recordingEmitter) record(e emission) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.emissions = append(r.emissions, e)
+	return r.err
+}
+
+// recorded returns a copy of the emissions so far, for checking them while
+// something else may still be emitting
+func (r *recordingEmitter) recorded() []emission {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]emission(nil), r.emissions...)
+}
+
+func (r *recordingEmitter) Timing(stat string, value float64, tags []string) error {
+	return r.record(emission{kind: "timing", name: stat, value: value, tags: tags})
+}
+
+func (r *recordingEmitter) Gauge(stat string, value float64, tags []string) error {
+	return r.record(emission{kind: "gauge", name: stat, value: value, tags: tags})
+}
+
+func (r *recordingEmitter) Count(stat string, count float64, tags []string) error {
+	return r.record(emission{kind: "count", name: stat, value: count, tags: tags})
+}
+
+func (r *recordingEmitter) Event(title, body string, fields map[string]string, tags []string) error {
+	return r.record(emission{kind: "event", name: title, body: body, tags: tags})
+}
+
+func (r *recordingEmitter) ServiceCheck(name string, status int, fields map[string]string, tags []string) error {
+	return r.record(emission{kind: "service_check", name: name, value: float64(status), body: fields["service_check_message"], tags: tags})
+}
+
+func (*TestSuite) Test_newMultiEmitter(c *C) {
+	_, ok := newMultiEmitter().(noopEmitter)
+	c.Check(ok, Equals, true)
+
+	r1 := &recordingEmitter{}
+	c.Check(newMultiEmitter(r1), Equals, r1)
+
+	r2 := &recordingEmitter{err: errors.New("r2 failed")}
+	r3 := &recordingEmitter{err: errors.New("r3 failed")}
+
+	m := newMultiEmitter(r1, r2, r3)
+
+	// every emitter gets called, and the first error is returned
+	err := m.Gauge("test.gauge", 42, []string{"tag1"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "r2 failed")
+
+	c.Check(m.Timing("test.time", 1, nil), Not(IsNil))
+	c.Check(m.Count("test.count", 1, nil), Not(IsNil))
+	c.Check(m.Event("title", "body", nil, nil), Not(IsNil))
+	c.Check(m.ServiceCheck("test.status", 0, nil, nil), Not(IsNil))
+
+	for _, r := range []*recordingEmitter{r1, r2, r3} {
+		c.Assert(r.emissions, HasLen, 5)
+		c.Check(r.emissions[0], DeepEquals, emission{kind: "gauge", name: "test.gauge", value: 42, tags: []string{"tag1"}})
+		c.Check(r.emissions[1].kind, Equals, "timing")
+		c.Check(r.emissions[2].kind, Equals, "count")
+		c.Check(r.emissions[3].kind, Equals, "event")
+		c.Check(r.emissions[4].kind, Equals, "service_check")
+	}
+}
+
+func (*TestSuite) Test_handleCommand_recordingEmitter(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			Namespace: "cronner",
+			LockDir:   c.MkDir(),
+			LogPath:   c.MkDir(),
+			FailEvent: true,
+			Group:     "testgroup",
+		},
+		cmd: exec.Command("/bin/sh", "-c", "echo oops; exit 3"),
+	}
+
+	retCode, _, runTime, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 3)
+
+	c.Assert(r.emissions, HasLen, 3)
+	c.Check(r.emissions[0], DeepEquals, emission{kind: "timing", name: "testCmd.time", value: runTime, tags: []string{"cronner_group:testgroup"}})
+	c.Check(r.emissions[1], DeepEquals, emission{kind: "gauge", name: "testCmd.exit_code", value: 3, tags: []string{"cronner_group:testgroup"}})
+	c.Check(r.emissions[2].kind, Equals, "event")
+	c.Check(r.emissions[2].body, Equals, "UUID: "+testCronnerUUID+"\nexit code: 3\noutput: oops\n")
+}
@@ -0,0 +1,320 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Some of what can be asked for about the command, like its resource limits,
+// has to be set up in the command's process before the command is run, which
+// exec.Cmd has no way of doing. When any of it is asked for, cronner starts
+// itself with the execHelperArg argument instead; the exec helper sets things
+// up and then execs the command, so that the command ends up running in the
+// process cronner started, as if it had been started directly.
+
+// execHelperArg is the first argument cronner is started with to be the exec
+// helper; it's not a subcommand, as it's not meant to be run by hand
+const execHelperArg = "__exec"
+
+// execHelperArgs returns the arguments for the exec helper to set up what the
+// options ask for, or nil if there is nothing to set up
+func execHelperArgs(opts *binArgs) []string {
+	var args []string
+
+	if opts.Nice != 0 {
+		args = append(args, "--nice", strconv.Itoa(opts.Nice))
+	}
+
+	if prio := ioprio(opts); prio >= 0 {
+		args = append(args, "--ioprio", strconv.Itoa(prio))
+	}
+
+	for _, l := range opts.Limits {
+		args = append(args, "--rlimit", fmt.Sprintf("%d:%d", l.resource, l.value))
+	}
+
+	return args
+}
+
+// startCommand starts the command, through the exec helper if there is
+// anything to set up in its process first. With --cgroup the command's cgroup
+// is created for the first attempt, and the exec helper waits for cronner to
+// move it into the cgroup before running the command.
+func startCommand(hndlr *cmdHandler) error {
+	helperArgs := execHelperArgs(hndlr.opts)
+
+	if hndlr.opts.Cgroup && hndlr.cgroup == nil {
+		cg, err := newJobCgroup(hndlr)
+		if err != nil {
+			return err
+		}
+
+		hndlr.cgroup = cg
+	}
+
+	if len(helperArgs) == 0 && hndlr.cgroup == nil {
+		return hndlr.cmd.Start()
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the cronner binary to start the command with: %v", err)
+	}
+
+	cmd := hndlr.cmd
+	path, args, extraFiles := cmd.Path, cmd.Args, cmd.ExtraFiles
+	cred := commandCredential(hndlr)
+
+	// the command is put back once it has started, as the rest of cronner
+	// reports on it rather than the exec helper
+	defer func() {
+		cmd.Path, cmd.Args, cmd.ExtraFiles = path, args, extraFiles
+
+		if cred != nil {
+			cmd.SysProcAttr.Credential = cred
+		}
+	}()
+
+	// the exec helper runs as cronner does, and switches to the command's
+	// user itself once it has set up what could need cronner's privileges
+	if cred != nil {
+		cmd.SysProcAttr.Credential = nil
+		helperArgs = append(helperArgs, "--credential", helperCredential(cred))
+	}
+
+	// the exec helper waits until something is written to the ready pipe
+	var ready *os.File
+
+	if hndlr.cgroup != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return fmt.Errorf("failed to create a pipe to start the command with: %v", err)
+		}
+
+		defer r.Close()
+		defer w.Close()
+
+		ready = w
+
+		// the extra files are the file descriptors after stderr
+		cmd.ExtraFiles = append(extraFiles[:len(extraFiles):len(extraFiles)], r)
+		helperArgs = append(helperArgs, "--wait-fd", strconv.Itoa(2+len(cmd.ExtraFiles)))
+	}
+
+	cmd.Path = self
+	cmd.Args = append([]string{self, execHelperArg}, helperArgs...)
+	cmd.Args = append(append(cmd.Args, "--", path), args...)
+
+	if err = cmd.Start(); err != nil || ready == nil {
+		return err
+	}
+
+	if err = hndlr.cgroup.addProcess(cmd.Process.Pid); err != nil {
+		// closing the pipe without writing to it makes the exec helper
+		// give up without running the command
+		ready.Close()
+		cmd.Wait()
+
+		return err
+	}
+
+	ready.Write([]byte{1})
+
+	return nil
+}
+
+// execHelper is the exec helper: it sets up what its arguments ask for in its
+// own process, and then execs the command. Its arguments are the options, then
+// "--", the path of the command, and its arguments starting with argv[0].
+//
+// It only returns if something went wrong, with the exit code to use; what
+// went wrong is written to stderr, which is the command's stderr.
+func execHelper(args []string, stderr io.Writer) int {
+	var limits []rlimit
+	var cred *syscall.Credential
+	var i, nice int
+
+	waitFd, prio := -1, -1
+
+	for i = 0; i < len(args) && args[i] != "--"; i += 2 {
+		if i+1 >= len(args) {
+			fmt.Fprintf(stderr, "cronner: exec helper option %v is missing its value\n", args[i])
+			return intErrCode
+		}
+
+		var err error
+
+		switch args[i] {
+		case "--rlimit":
+			var l rlimit
+
+			if l, err = parseHelperLimit(args[i+1]); err == nil {
+				limits = append(limits, l)
+			}
+		case "--nice":
+			if nice, err = strconv.Atoi(args[i+1]); err != nil {
+				err = fmt.Errorf("invalid exec helper niceness '%v'", args[i+1])
+			}
+		case "--ioprio":
+			if prio, err = strconv.Atoi(args[i+1]); err != nil {
+				err = fmt.Errorf("invalid exec helper I/O priority '%v'", args[i+1])
+			}
+		case "--credential":
+			cred, err = parseHelperCredential(args[i+1])
+		case "--wait-fd":
+			if waitFd, err = strconv.Atoi(args[i+1]); err != nil {
+				err = fmt.Errorf("invalid exec helper file descriptor '%v'", args[i+1])
+			}
+		default:
+			err = fmt.Errorf("unknown exec helper option %v", args[i])
+		}
+
+		if err != nil {
+			fmt.Fprintf(stderr, "cronner: %v\n", err)
+			return intErrCode
+		}
+	}
+
+	// skip the "--", and there must be a path and argv[0] after it
+	if len(args)-i < 3 {
+		fmt.Fprintf(stderr, "cronner: the exec helper needs a command to run\n")
+		return intErrCode
+	}
+
+	path, argv := args[i+1], args[i+2:]
+
+	if waitFd >= 0 && !waitReady(waitFd) {
+		fmt.Fprintf(stderr, "cronner: the command wasn't run, as its process couldn't be set up\n")
+		return intErrCode
+	}
+
+	// the priorities are those of the thread that sets them, so this has to
+	// stay on the thread that execs the command
+	runtime.LockOSThread()
+
+	if nice != 0 {
+		if err := setNice(nice); err != nil {
+			fmt.Fprintf(stderr, "cronner: %v\n", err)
+			return intErrCode
+		}
+	}
+
+	if prio >= 0 {
+		if err := setIOPriority(prio); err != nil {
+			fmt.Fprintf(stderr, "cronner: %v\n", err)
+			return intErrCode
+		}
+	}
+
+	// the resource limits are set after everything else, as they could get
+	// in the way of setting it up
+	for _, l := range limits {
+		if err := l.set(); err != nil {
+			fmt.Fprintf(stderr, "cronner: %v\n", err)
+			return intErrCode
+		}
+	}
+
+	// the user is switched to last, as lowering the niceness, the realtime
+	// I/O class, and raising the hard resource limits need cronner's
+	// privileges
+	if cred != nil {
+		if err := setCredential(cred); err != nil {
+			fmt.Fprintf(stderr, "cronner: %v\n", err)
+			return intErrCode
+		}
+	}
+
+	err := syscall.Exec(path, argv, os.Environ())
+
+	fmt.Fprintf(stderr, "cronner: failed to run '%v': %v\n", path, err)
+	return intErrCode
+}
+
+// waitReady waits for cronner to write to the ready pipe, which is the file
+// descriptor fd, and closes it so the command doesn't get it; it returns false
+// if the pipe was closed without being written to
+func waitReady(fd int) bool {
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	n, _ := f.Read(make([]byte, 1))
+	return n == 1
+}
+
+// parseHelperLimit parses the <resource>:<value> value of the exec helper's
+// --rlimit option
+func parseHelperLimit(s string) (rlimit, error) {
+	parts := strings.SplitN(s, ":", 2)
+
+	if len(parts) == 2 {
+		resource, err := strconv.Atoi(parts[0])
+
+		if err == nil {
+			var value uint64
+
+			if value, err = strconv.ParseUint(parts[1], 10, 64); err == nil {
+				return rlimit{resource: resource, value: value}, nil
+			}
+		}
+	}
+
+	return rlimit{}, fmt.Errorf("invalid exec helper resource limit '%v'", s)
+}
+
+// helperCredential formats the credential for the exec helper's --credential
+// option, as <uid>:<gid>:<comma separated supplementary groups>
+func helperCredential(cred *syscall.Credential) string {
+	groups := make([]string, len(cred.Groups))
+
+	for i, gid := range cred.Groups {
+		groups[i] = strconv.FormatUint(uint64(gid), 10)
+	}
+
+	return fmt.Sprintf("%d:%d:%v", cred.Uid, cred.Gid, strings.Join(groups, ","))
+}
+
+// parseHelperCredential parses the value of the exec helper's --credential
+// option
+func parseHelperCredential(s string) (*syscall.Credential, error) {
+	invalid := fmt.Errorf("invalid exec helper credential '%v'", s)
+
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return nil, invalid
+	}
+
+	uid, err := parseID(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+
+	gid, err := parseID(parts[1])
+	if err != nil {
+		return nil, invalid
+	}
+
+	cred := &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+
+	if len(parts[2]) > 0 {
+		for _, group := range strings.Split(parts[2], ",") {
+			id, err := parseID(group)
+			if err != nil {
+				return nil, invalid
+			}
+
+			cred.Groups = append(cred.Groups, id)
+		}
+	}
+
+	return cred, nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/theckman/go-flock"
+	"github.com/tideland/golib/logger"
+)
+
+// historyDateFormat is the format of the date in the history segment file
+// names; each segment holds the runs that finished on that day (in UTC)
+const historyDateFormat = "20060102"
+
+const (
+	historyFilePrefix = "history-"
+	historyFileSuffix = ".jsonl"
+)
+
+// the outcomes of the runs that ended before the command was run
+const (
+	historyOutcomeSkipped = "skipped"
+	historyOutcomeNotRun  = "not run"
+)
+
+// historyRecord is a single run of a job in the history store
+type historyRecord struct {
+	UUID     string    `json:"uuid"`
+	Label    string    `json:"label"`
+	Group    string    `json:"group,omitempty"`
+	Command  string    `json:"command"`
+	Host     string    `json:"host"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_seconds"`
+	ExitCode int       `json:"exit_code"`
+	Outcome  string    `json:"outcome,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Tags     []string  `json:"tags,omitempty"`
+	LogFiles []string  `json:"log_files,omitempty"`
+}
+
+// newHistoryRecord returns the record of this run of the command, for the
+// caller to fill in how it went. With -s/--sensitive only the command is
+// recorded, as its arguments may have secrets in them.
+func newHistoryRecord(hndlr *cmdHandler) *historyRecord {
+	return &historyRecord{
+		UUID:    hndlr.uuid,
+		Label:   hndlr.opts.Label,
+		Group:   hndlr.opts.Group,
+		Command: commandLine(hndlr),
+		Host:    hndlr.hostname,
+		Tags:    hndlr.opts.Tags,
+	}
+}
+
+// outcome returns how the run went; runs recorded before outcomes were have
+// the exit code to go by
+func (rec *historyRecord) outcome() string {
+	switch {
+	case len(rec.Outcome) > 0:
+		return rec.Outcome
+	case rec.ExitCode == 0:
+		return "succeeded"
+	default:
+		return "failed"
+	}
+}
+
+// recordNotRun records a run that ended without the command being run, as it
+// was skipped or something went wrong before it could be, with reason being
+// why; it does nothing without a --history-dir
+func recordNotRun(hndlr *cmdHandler, invoked time.Time, ret int, outcome string, reason error) {
+	if len(hndlr.opts.HistoryDir) == 0 {
+		return
+	}
+
+	rec := newHistoryRecord(hndlr)
+	rec.Start, rec.End = invoked, time.Now()
+	rec.Duration = rec.End.Sub(rec.Start).Seconds()
+	rec.ExitCode = ret
+	rec.Outcome = outcome
+	rec.Error = reason.Error()
+
+	if err := recordHistory(hndlr.opts.HistoryDir, hndlr.opts.HistoryRetention, rec); err != nil {
+		logger.Errorf("%v", err)
+	}
+}
+
+// historySegment returns the name of the segment file for runs finishing at t
+func historySegment(t time.Time) string {
+	return historyFilePrefix + t.UTC().Format(historyDateFormat) + historyFileSuffix
+}
+
+// historySegmentDate parses the date out of a segment file name
+func historySegmentDate(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, historyFilePrefix) || !strings.HasSuffix(name, historyFileSuffix) {
+		return time.Time{}, false
+	}
+
+	date, err := time.Parse(historyDateFormat, strings.TrimSuffix(strings.TrimPrefix(name, historyFilePrefix), historyFileSuffix))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return date, true
+}
+
+// recordHistory appends the run to the history store in dir, and then removes
+// the segments that are older than retentionDays. Nothing is recorded if dir
+// doesn't exist, so that the history is only kept on the hosts it was set up.
+// The segments aren't readable by everyone, as the commands may be sensitive.
+func recordHistory(dir string, retentionDays uint64, rec *historyRecord) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		logger.Infof("history directory '%v' does not exist, not recording the run", dir)
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to encode history record: %v", err)
+	}
+
+	// serialize the writers, so that lines from concurrent jobs can't be
+	// interleaved and pruning doesn't race with appending
+	lock := flock.NewFlock(path.Join(dir, ".lock"))
+
+	if err = lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock history directory '%v': %v", dir, err)
+	}
+
+	defer lock.Unlock()
+
+	filename := path.Join(dir, historySegment(rec.End))
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open history file '%v': %v", filename, err)
+	}
+
+	_, err = file.Write(append(line, '\n'))
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write to history file '%v': %v", filename, err)
+	}
+
+	if retentionDays > 0 {
+		return pruneHistory(dir, rec.End.AddDate(0, 0, -int(retentionDays)))
+	}
+
+	return nil
+}
+
+// pruneHistory removes the segments holding only runs from before cutoff
+func pruneHistory(dir string, cutoff time.Time) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to list history directory '%v': %v", dir, err)
+	}
+
+	cutoffDay := cutoff.UTC().Truncate(24 * time.Hour)
+
+	for _, file := range files {
+		date, ok := historySegmentDate(file.Name())
+
+		if !ok || !date.Before(cutoffDay) {
+			continue
+		}
+
+		if err = os.Remove(path.Join(dir, file.Name())); err != nil {
+			return fmt.Errorf("failed to remove old history file: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// historyFilter selects which runs readHistory returns
+type historyFilter struct {
+	label  string
+	since  time.Time
+	failed bool
+}
+
+func (f historyFilter) match(rec *historyRecord) bool {
+	if len(f.label) > 0 && rec.Label != f.label {
+		return false
+	}
+
+	if f.failed && rec.ExitCode == 0 {
+		return false
+	}
+
+	return rec.End.After(f.since) || rec.End.Equal(f.since)
+}
+
+// readHistory returns the runs in the history store matching filter, oldest
+// first; lines that can't be parsed, such as one that was being written when
+// the host crashed, are skipped
+func readHistory(dir string, filter historyFilter) ([]historyRecord, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list history directory '%v': %v", dir, err)
+	}
+
+	sinceDay := filter.since.UTC().Truncate(24 * time.Hour)
+
+	var records []historyRecord
+
+	for _, file := range files {
+		date, ok := historySegmentDate(file.Name())
+
+		if !ok || date.Before(sinceDay) {
+			continue
+		}
+
+		f, err := os.Open(path.Join(dir, file.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open history file: %v", err)
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+		for scanner.Scan() {
+			var rec historyRecord
+
+			if json.Unmarshal(scanner.Bytes(), &rec) != nil {
+				continue
+			}
+
+			if filter.match(&rec) {
+				records = append(records, rec)
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read history file '%v': %v", file.Name(), err)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].End.Before(records[j].End) })
+
+	return records, nil
+}
+
+// historyArgs are the arguments of the history subcommand
+type historyArgs struct {
+	HistoryDir string `long:"history-dir" default:"/var/lib/cronner/history" value-name:"<dir>" description:"the directory the run history is kept in"`
+	Label      string `short:"l" long:"label" description:"only show the runs of the job with this label"`
+	Since      string `long:"since" value-name:"<duration>" description:"only show the runs that finished within this long, like 90m or 24h"`
+	Failed     bool   `long:"failed" description:"only show the runs that failed"`
+	JSON       bool   `long:"json" description:"print the runs as a JSON array"`
+}
+
+// parse parses the arguments of the history subcommand, which are everything
+// after the subcommand name, into a historyFilter
+func (h *historyArgs) parse(args []string) (historyFilter, string, error) {
+	var filter historyFilter
+
+	p := flags.NewParser(h, flags.HelpFlag)
+	p.Name = "cronner history"
+
+	if _, err := p.ParseArgs(args); err != nil {
+		if errType, ok := err.(*flags.Error); ok && errType.Type == flags.ErrHelp {
+			return filter, err.Error(), nil
+		}
+
+		return filter, "", err
+	}
+
+	filter.label = strings.Replace(strings.ToLower(h.Label), " ", "_", -1)
+	filter.failed = h.Failed
+
+	if len(h.Since) > 0 {
+		since, err := time.ParseDuration(h.Since)
+		if err != nil || since <= 0 {
+			return filter, "", fmt.Errorf("since '%v' is invalid, it must be a positive duration like 90m or 24h", h.Since)
+		}
+
+		filter.since = time.Now().Add(-since)
+	}
+
+	return filter, "", nil
+}
+
+// printHistory writes the runs to w, either as a table or as JSON
+func printHistory(w io.Writer, records []historyRecord, asJSON bool) error {
+	if asJSON {
+		if records == nil {
+			records = []historyRecord{}
+		}
+
+		out, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "START\tDURATION\tEXIT\tOUTCOME\tLABEL\tHOST\tUUID")
+
+	for _, rec := range records {
+		fmt.Fprintf(tw, "%v\t%.3fs\t%d\t%v\t%v\t%v\t%v\n", rec.Start.UTC().Format(time.RFC3339), rec.Duration, rec.ExitCode, rec.outcome(), rec.Label, rec.Host, rec.UUID)
+	}
+
+	return tw.Flush()
+}
+
+// historyCmd is the history subcommand, which prints the runs recorded in the
+// history store; it returns the exit code
+func historyCmd(args []string, stdout, stderr io.Writer) int {
+	h := &historyArgs{}
+
+	filter, output, err := h.parse(args)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	if len(output) > 0 {
+		fmt.Fprint(stdout, output)
+		return 0
+	}
+
+	records, err := readHistory(h.HistoryDir, filter)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	if err = printHistory(stdout, records, h.JSON); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,275 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/theckman/go-flock"
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_recordHistory(c *C) {
+	dir := c.MkDir()
+
+	// nothing is recorded if the directory doesn't exist
+	c.Assert(recordHistory(path.Join(dir, "missing"), 30, &historyRecord{}), IsNil)
+
+	_, err := os.Stat(path.Join(dir, "missing"))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	end := time.Now().UTC()
+
+	recs := []*historyRecord{
+		{UUID: "uuid1", Label: "old", End: end.AddDate(0, 0, -40)},
+		{UUID: "uuid2", Label: "testcmd", End: end.Add(-time.Hour * 2), ExitCode: 0},
+		{UUID: "uuid3", Label: "testcmd", End: end.Add(-time.Minute), ExitCode: 1},
+		{UUID: "uuid4", Label: "other", End: end, ExitCode: 2},
+	}
+
+	// keep everything to start with
+	for _, rec := range recs {
+		c.Assert(recordHistory(dir, 0, rec), IsNil)
+	}
+
+	// a partially written line is skipped
+	file, err := os.OpenFile(path.Join(dir, historySegment(end)), os.O_WRONLY|os.O_APPEND, 0644)
+	c.Assert(err, IsNil)
+	_, err = file.WriteString(`{"uuid":"trunc`)
+	c.Assert(err, IsNil)
+	c.Assert(file.Close(), IsNil)
+
+	uuids := func(records []historyRecord) []string {
+		var u []string
+		for _, rec := range records {
+			u = append(u, rec.UUID)
+		}
+		return u
+	}
+
+	records, err := readHistory(dir, historyFilter{})
+	c.Assert(err, IsNil)
+	c.Check(uuids(records), DeepEquals, []string{"uuid1", "uuid2", "uuid3", "uuid4"})
+
+	records, err = readHistory(dir, historyFilter{label: "testcmd"})
+	c.Assert(err, IsNil)
+	c.Check(uuids(records), DeepEquals, []string{"uuid2", "uuid3"})
+
+	records, err = readHistory(dir, historyFilter{failed: true})
+	c.Assert(err, IsNil)
+	c.Check(uuids(records), DeepEquals, []string{"uuid3", "uuid4"})
+
+	records, err = readHistory(dir, historyFilter{since: end.Add(-time.Hour)})
+	c.Assert(err, IsNil)
+	c.Check(uuids(records), DeepEquals, []string{"uuid3", "uuid4"})
+
+	// recording with a retention period removes the old segments
+	rec := &historyRecord{UUID: "uuid5", Label: "testcmd", End: end}
+	c.Assert(recordHistory(dir, 30, rec), IsNil)
+
+	records, err = readHistory(dir, historyFilter{})
+	c.Assert(err, IsNil)
+	c.Check(uuids(records)[0], Equals, "uuid2")
+
+	_, err = os.Stat(path.Join(dir, historySegment(recs[0].End)))
+	c.Check(os.IsNotExist(err), Equals, true)
+}
+
+func (*TestSuite) Test_historyArgs(c *C) {
+	h := &historyArgs{}
+
+	filter, output, err := h.parse([]string{"--label", "Test Cmd", "--since", "90m", "--failed", "--json"})
+	c.Assert(err, IsNil)
+	c.Check(output, Equals, "")
+	c.Check(h.HistoryDir, Equals, "/var/lib/cronner/history")
+	c.Check(h.JSON, Equals, true)
+	c.Check(filter.label, Equals, "test_cmd")
+	c.Check(filter.failed, Equals, true)
+	c.Check(time.Since(filter.since) >= time.Minute*90, Equals, true)
+	c.Check(time.Since(filter.since) < time.Minute*91, Equals, true)
+
+	h = &historyArgs{}
+	_, output, err = h.parse([]string{"--help"})
+	c.Assert(err, IsNil)
+	c.Check(strings.HasPrefix(output, "Usage:\n  cronner history"), Equals, true)
+
+	h = &historyArgs{}
+	_, _, err = h.parse([]string{"--since", "yesterday"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "since 'yesterday' is invalid, it must be a positive duration like 90m or 24h")
+}
+
+func (*TestSuite) Test_historyCmd(c *C) {
+	dir := c.MkDir()
+	start := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	c.Assert(recordHistory(dir, 0, &historyRecord{
+		UUID:     "uuid1",
+		Label:    "testcmd",
+		Command:  "/bin/false",
+		Host:     "brainbox01",
+		Start:    start,
+		End:      start.Add(time.Millisecond * 1500),
+		Duration: 1.5,
+		ExitCode: 1,
+	}), IsNil)
+
+	var stdout, stderr bytes.Buffer
+
+	c.Check(historyCmd([]string{"--history-dir", dir}, &stdout, &stderr), Equals, 0)
+	c.Check(stderr.String(), Equals, "")
+	c.Check(stdout.String(), Equals, ""+
+		"START                 DURATION  EXIT  OUTCOME  LABEL    HOST        UUID\n"+
+		"2017-03-01T12:00:00Z  1.500s    1     failed   testcmd  brainbox01  uuid1\n")
+
+	stdout.Reset()
+	c.Check(historyCmd([]string{"--history-dir", dir, "--json"}, &stdout, &stderr), Equals, 0)
+
+	var records []historyRecord
+	c.Assert(json.Unmarshal(stdout.Bytes(), &records), IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Check(records[0].Command, Equals, "/bin/false")
+
+	// an empty result is still valid JSON
+	stdout.Reset()
+	c.Check(historyCmd([]string{"--history-dir", dir, "--json", "--label", "other"}, &stdout, &stderr), Equals, 0)
+	c.Check(stdout.String(), Equals, "[]\n")
+
+	c.Check(historyCmd([]string{"--history-dir", path.Join(dir, "missing")}, &stdout, &stderr), Equals, 1)
+	c.Check(strings.HasPrefix(stderr.String(), "error: failed to list history directory"), Equals, true)
+}
+
+func (*TestSuite) Test_handleCommand_history(c *C) {
+	dir := c.MkDir()
+	logDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:      "testCmd",
+			Group:      "testGroup",
+			Tags:       []string{"tag1"},
+			LogPath:    logDir,
+			LogFail:    true,
+			HistoryDir: dir,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "exit 3"),
+	}
+
+	_, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Check(len(files) > 0, Equals, true)
+
+	records, err := readHistory(dir, historyFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+
+	rec := records[0]
+	c.Check(rec.UUID, Equals, testCronnerUUID)
+	c.Check(rec.Label, Equals, "testCmd")
+	c.Check(rec.Group, Equals, "testGroup")
+	c.Check(rec.Command, Equals, "/bin/sh -c exit 3")
+	c.Check(rec.Host, Equals, "brainbox01")
+	c.Check(rec.ExitCode, Equals, 3)
+	c.Check(rec.Tags, DeepEquals, []string{"tag1"})
+	c.Check(rec.LogFiles, DeepEquals, []string{path.Join(logDir, fmt.Sprintf("testCmd-%v.out", testCronnerUUID))})
+	c.Check(rec.Outcome, Equals, "failed")
+	c.Check(rec.End.Before(rec.Start), Equals, false)
+
+	// the history isn't readable by everyone
+	stat, err := os.Stat(path.Join(dir, historySegment(rec.End)))
+	c.Assert(err, IsNil)
+	c.Check(stat.Mode().Perm(), Equals, os.FileMode(0640))
+
+	// the arguments aren't recorded for sensitive commands
+	h.opts.Sensitive = true
+	h.cmd = exec.Command("/bin/sh", "-c", "echo hunter2")
+
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+
+	records, err = readHistory(dir, historyFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Check(records[1].Command, Equals, "/bin/sh")
+	c.Check(records[1].Outcome, Equals, "succeeded")
+}
+
+func (*TestSuite) Test_handleCommand_historyNotRun(c *C) {
+	dir := c.MkDir()
+	lockDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     lockDir,
+			Lock:        true,
+			LockBackend: lockBackendFlock,
+			OnLocked:    onLockedSkip,
+			HistoryDir:  dir,
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	// runs that end before the command is run are recorded too
+	held := flock.NewFlock(path.Join(lockDir, "cronner-testCmd.lock"))
+	locked, err := held.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	defer held.Unlock()
+
+	retCode, _, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+
+	h.opts.OnLocked = onLockedFail
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 200)
+
+	h.opts.User = "cronner-no-such-user"
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 200)
+
+	records, err := readHistory(dir, historyFilter{})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 3)
+
+	c.Check(records[0].Outcome, Equals, "skipped")
+	c.Check(records[0].ExitCode, Equals, 0)
+	c.Check(strings.HasPrefix(records[0].Error, "failed to obtain lock on"), Equals, true, Commentf("error: %q", records[0].Error))
+
+	c.Check(records[1].Outcome, Equals, "not run")
+	c.Check(records[1].ExitCode, Equals, 200)
+	c.Check(strings.HasPrefix(records[1].Error, "failed to obtain lock on"), Equals, true, Commentf("error: %q", records[1].Error))
+
+	c.Check(records[2].Outcome, Equals, "not run")
+	c.Check(records[2].Error, Equals, "user 'cronner-no-such-user' does not exist")
+
+	// only the failures show up as failed
+	records, err = readHistory(dir, historyFilter{failed: true})
+	c.Assert(err, IsNil)
+	c.Check(records, HasLen, 2)
+}
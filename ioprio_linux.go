@@ -0,0 +1,26 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// ioprioSupported is whether --ionice-class can be used
+const ioprioSupported = true
+
+// ioprioWhoProcess is IOPRIO_WHO_PROCESS, for ioprio_set(2) to set the I/O
+// priority of a thread
+const ioprioWhoProcess = 1
+
+// setIOPriority sets the I/O priority of the calling thread
+func setIOPriority(prio int) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return fmt.Errorf("failed to set the I/O priority from --ionice-class: %v", errno)
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+//
+// +build !linux
+
+package main
+
+import "fmt"
+
+// ioprioSupported is whether --ionice-class can be used
+const ioprioSupported = false
+
+// setIOPriority fails, as I/O priorities are only supported on Linux
+func setIOPriority(prio int) error {
+	return fmt.Errorf("--ionice-class is only supported on Linux")
+}
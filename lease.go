@@ -0,0 +1,312 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The lease lock backend keeps lease files in the lock directory, which is
+// meant to be on a filesystem shared by the hosts, like NFS. A lease says who
+// holds it and until when; the holder renews it every third of the --lock-ttl
+// while the job runs, and once it expires anyone can take it over. This relies
+// on the clocks of the hosts being in sync to well within the TTL.
+//
+// File locks aren't reliable on every shared filesystem, so each lease is its
+// own file, named after its fencing token, and the lease with the highest
+// token is the current one. Taking over an expired lease claims the next token
+// by creating its file with a hard link, which fails if another host claimed
+// it first, so no two hosts ever get the same token no matter how long either
+// of them stalls. A lease file is only ever replaced by its own holder, when
+// renewing it, and the two latest ones are kept so that a host that read an
+// old lease can always tell that it's out of date.
+
+// lease is the contents of a lease file
+type lease struct {
+	Holder  lockHolder `json:"holder"`
+	Token   int64      `json:"token"`
+	Expires time.Time  `json:"expires"`
+}
+
+// readLease reads the lease file
+func readLease(filename string) (*lease, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lease{}
+
+	if err = json.Unmarshal(contents, l); err != nil {
+		return nil, fmt.Errorf("failed to parse lease file '%v': %v", filename, err)
+	}
+
+	return l, nil
+}
+
+// writeLease replaces the lease file with the lease
+func writeLease(filename string, l *lease) error {
+	contents, err := json.Marshal(l)
+	if err != nil {
+		return fmt.Errorf("failed to encode lease: %v", err)
+	}
+
+	return writeFileAtomic(filename, append(contents, '\n'), 0600)
+}
+
+// leaseLock is the lease lock backend, which keeps runs of the job on any host
+// sharing the lock directory from running at the same time
+type leaseLock struct {
+	filename string
+	ttl      time.Duration
+	holder   *lockHolder
+	hndlr    *cmdHandler
+
+	// held is the lease, while it's held
+	held *lease
+
+	// stop tells the goroutine renewing the lease to stop, and it closes
+	// done once it has
+	stop, done chan struct{}
+}
+
+// newLeaseLock returns the lease lock for the job, in the lock directory
+func newLeaseLock(hndlr *cmdHandler) *leaseLock {
+	return &leaseLock{
+		filename: path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.lease", hndlr.opts.Label)),
+		ttl:      time.Second * time.Duration(hndlr.opts.LockTTL),
+		holder:   newLockHolder(hndlr),
+		hndlr:    hndlr,
+	}
+}
+
+func (l *leaseLock) String() string {
+	return l.filename
+}
+
+// leaseFile returns the name of the lease file with the fencing token
+func (l *leaseLock) leaseFile(token int64) string {
+	return fmt.Sprintf("%v.%d", l.filename, token)
+}
+
+// tokens returns the fencing tokens of the lease files, in order
+func (l *leaseLock) tokens() ([]int64, error) {
+	prefix := l.filename + "."
+
+	files, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the lease files: %v", err)
+	}
+
+	var tokens []int64
+
+	for _, file := range files {
+		if n, err := strconv.ParseInt(strings.TrimPrefix(file, prefix), 10, 64); err == nil && n > 0 {
+			tokens = append(tokens, n)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i] < tokens[j] })
+
+	return tokens, nil
+}
+
+// latestToken returns the highest fencing token of the lease files, or 0 if
+// there aren't any
+func (l *leaseLock) latestToken() (int64, error) {
+	tokens, err := l.tokens()
+	if err != nil || len(tokens) == 0 {
+		return 0, err
+	}
+
+	return tokens[len(tokens)-1], nil
+}
+
+// current returns the current lease, or nil if there isn't one
+func (l *leaseLock) current() (*lease, error) {
+	token, err := l.latestToken()
+	if err != nil || token == 0 {
+		return nil, err
+	}
+
+	return readLease(l.leaseFile(token))
+}
+
+func (l *leaseLock) tryLock() (bool, error) {
+	token, err := l.latestToken()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	if token > 0 {
+		current, err := readLease(l.leaseFile(token))
+		if err != nil {
+			return false, err
+		}
+
+		if now.Before(current.Expires) {
+			return false, nil
+		}
+	}
+
+	l.holder.Start = now
+	ours := &lease{Holder: *l.holder, Token: token + 1, Expires: now.Add(l.ttl)}
+
+	if ok, err := l.claim(ours); err != nil || !ok {
+		return false, err
+	}
+
+	l.held = ours
+	l.stop, l.done = make(chan struct{}), make(chan struct{})
+
+	go renewLock(l, l.hndlr, l.ttl, l.renew, l.stop, l.done)
+
+	return true, nil
+}
+
+// claim creates the lease file for the fencing token of our lease; it returns
+// false if another host claimed the token first, or if a newer lease was
+// claimed while we were deciding to take over an old one
+func (l *leaseLock) claim(ours *lease) (bool, error) {
+	filename := l.leaseFile(ours.Token)
+
+	contents, err := json.Marshal(ours)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode lease: %v", err)
+	}
+
+	tmpName, err := writeTempFile(filename, append(contents, '\n'), 0600)
+	if err != nil {
+		return false, err
+	}
+
+	defer os.Remove(tmpName)
+
+	// this fails if the token has been claimed
+	if err = os.Link(tmpName, filename); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+
+		return false, fmt.Errorf("failed to create lease file: %v", err)
+	}
+
+	tokens, err := l.tokens()
+	if err != nil {
+		return false, err
+	}
+
+	// a lease file that was cleaned up after a newer lease was claimed can
+	// be claimed again by a host that read it long ago, but the newer lease
+	// is always still there to show that it's out of date
+	if len(tokens) == 0 || tokens[len(tokens)-1] != ours.Token {
+		os.Remove(filename)
+		return false, nil
+	}
+
+	// keep the lease before ours, and clean up the rest
+	for _, token := range tokens {
+		if token < ours.Token-1 {
+			os.Remove(l.leaseFile(token))
+		}
+	}
+
+	return true, nil
+}
+
+// isLatest returns whether the lease with the fencing token is the current one
+func (l *leaseLock) isLatest(token int64) (bool, error) {
+	latest, err := l.latestToken()
+	return latest == token, err
+}
+
+func (l *leaseLock) waitLock(deadline time.Time, fifo bool) (bool, error) {
+	return pollLock(l, deadline)
+}
+
+// replaceHeld replaces the held lease with next, if the held lease is still the
+// current one and hasn't expired, as another host may take over as soon as it
+// has; it returns whether the lease is still ours once it's written. Only we
+// write to the file of our lease, so writing it after another host has taken
+// over doesn't affect theirs.
+func (l *leaseLock) replaceHeld(next *lease) (bool, error) {
+	if !time.Now().Before(l.held.Expires) {
+		return false, nil
+	}
+
+	if ok, err := l.isLatest(l.held.Token); err != nil || !ok {
+		return false, err
+	}
+
+	if err := writeLease(l.leaseFile(next.Token), next); err != nil {
+		return false, err
+	}
+
+	ok, err := l.isLatest(next.Token)
+	if ok {
+		l.held = next
+	}
+
+	return ok, err
+}
+
+// renew pushes back the expiry of the lease, if it's still held
+func (l *leaseLock) renew() (bool, error) {
+	next := *l.held
+	next.Expires = time.Now().Add(l.ttl)
+
+	return l.replaceHeld(&next)
+}
+
+// unlock releases the lease by expiring it; the file is kept so that the next
+// holder's fencing token follows on from ours
+func (l *leaseLock) unlock() error {
+	if l.stop == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	l.stop, l.done = nil, nil
+
+	next := *l.held
+	next.Expires = time.Now()
+
+	_, err := l.replaceHeld(&next)
+	return err
+}
+
+func (l *leaseLock) holderDetail() string {
+	current, err := l.current()
+	if err != nil || current == nil || !time.Now().Before(current.Expires) {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%v)", &current.Holder)
+}
+
+func (l *leaseLock) fencingToken() (int64, bool) {
+	if l.held == nil {
+		return 0, true
+	}
+
+	return l.held.Token, true
+}
+
+func (l *leaseLock) kind() string {
+	return "lease"
+}
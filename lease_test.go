@@ -0,0 +1,254 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_leaseLock(c *C) {
+	lockDir := c.MkDir()
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     lockDir,
+			LockBackend: lockBackendLease,
+			LockTTL:     1,
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	filename := path.Join(lockDir, "cronner-testCmd.lease")
+
+	lock := newLeaseLock(h)
+	c.Check(lock.String(), Equals, filename)
+
+	locked, err := lock.tryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	token, ok := lock.fencingToken()
+	c.Check(ok, Equals, true)
+	c.Check(token, Equals, int64(1))
+
+	// someone else can't get it, and can see who has it
+	other := newLeaseLock(h)
+	other.holder.UUID = "other-uuid"
+
+	locked, err = other.tryLock()
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, false)
+	c.Check(strings.HasPrefix(other.holderDetail(), fmt.Sprintf(" (pid %d on brainbox01, uuid %v, held for ", os.Getpid(), testCronnerUUID)), Equals, true)
+
+	// the lease is renewed for as long as it's held, past its TTL
+	time.Sleep(time.Millisecond * 1500)
+
+	current, err := readLease(filename + ".1")
+	c.Assert(err, IsNil)
+	c.Check(current.Holder.UUID, Equals, testCronnerUUID)
+	c.Check(current.Expires.After(time.Now()), Equals, true)
+
+	// waiting for it to be released
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		lock.unlock()
+	}()
+
+	locked, err = other.waitLock(time.Now().Add(time.Second*5), false)
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, true)
+
+	// the fencing token follows on from the previous lease
+	token, _ = other.fencingToken()
+	c.Check(token, Equals, int64(2))
+	c.Check(other.holderDetail(), Not(Equals), "")
+
+	// losing the lease, because another host took it over
+	c.Assert(ioutil.WriteFile(filename+".3", []byte(`{"holder":{"uuid":"third-uuid"},"token":3,"expires":"2100-01-01T00:00:00Z"}`), 0644), IsNil)
+	time.Sleep(time.Millisecond * 500)
+
+	emissions := r.recorded()
+	c.Assert(emissions, HasLen, 1)
+	c.Check(emissions[0], DeepEquals, emission{kind: "count", name: "testCmd.lock_lost", value: 1, tags: []string{}})
+
+	// unlocking a lost lease leaves the new holder's alone
+	c.Check(other.unlock(), IsNil)
+
+	current, err = other.current()
+	c.Assert(err, IsNil)
+	c.Check(current.Holder.UUID, Equals, "third-uuid")
+
+	// taking over a lease that expired, because its holder went away
+	c.Assert(ioutil.WriteFile(filename+".7", []byte(`{"holder":{"uuid":"dead-uuid"},"token":7,"expires":"2017-01-01T00:00:00Z"}`), 0644), IsNil)
+
+	lock = newLeaseLock(h)
+
+	locked, err = lock.tryLock()
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, true)
+
+	token, _ = lock.fencingToken()
+	c.Check(token, Equals, int64(8))
+	c.Check(lock.unlock(), IsNil)
+
+	// nothing is left behind but the latest two leases
+	files, err := ioutil.ReadDir(lockDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	c.Check(files[0].Name(), Equals, "cronner-testCmd.lease.7")
+	c.Check(files[1].Name(), Equals, "cronner-testCmd.lease.8")
+}
+
+func (*TestSuite) Test_leaseLock_takeOver(c *C) {
+	lockDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter: &recordingEmitter{},
+		uuid:    testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     lockDir,
+			LockBackend: lockBackendLease,
+			LockTTL:     30,
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	lock := newLeaseLock(h)
+	expired := &lease{Holder: lockHolder{UUID: "dead-uuid"}, Token: 7, Expires: time.Now().Add(-time.Minute)}
+
+	// hosts taking over the same expired lease at the same time; only the
+	// one that claims the next token gets it
+	c.Assert(writeLease(lock.leaseFile(7), expired), IsNil)
+
+	locks := make([]*leaseLock, 3)
+	results := make(chan bool, len(locks))
+
+	for i := range locks {
+		locks[i] = newLeaseLock(h)
+		locks[i].holder.UUID = fmt.Sprintf("uuid-%d", i)
+
+		go func(l *leaseLock) {
+			locked, err := l.tryLock()
+			c.Check(err, IsNil)
+			results <- locked
+		}(locks[i])
+	}
+
+	var held int
+
+	for range locks {
+		if <-results {
+			held++
+		}
+	}
+
+	c.Check(held, Equals, 1)
+
+	var winner string
+
+	for _, l := range locks {
+		if l.held != nil {
+			token, _ := l.fencingToken()
+			c.Check(token, Equals, int64(8))
+			winner = l.holder.UUID
+		}
+	}
+
+	// a host that read the expired lease, but stalled until after the
+	// lease was taken over, doesn't get it however long it stalled
+	ok, err := lock.claim(&lease{Holder: lockHolder{UUID: "slow-uuid"}, Token: 8, Expires: time.Now().Add(time.Minute)})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	current, err := lock.current()
+	c.Assert(err, IsNil)
+	c.Check(current.Token, Equals, int64(8))
+	c.Check(current.Holder.UUID, Equals, winner)
+
+	for _, l := range locks {
+		c.Check(l.unlock(), IsNil)
+	}
+
+	// a host that read a lease whose file has since been cleaned up can
+	// claim its token again, but sees that there's a newer lease
+	ok, err = lock.claim(&lease{Holder: lockHolder{UUID: "other-uuid"}, Token: 9, Expires: time.Now().Add(time.Minute)})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	_, err = os.Stat(lock.leaseFile(7))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	ok, err = lock.claim(&lease{Holder: lockHolder{UUID: "slow-uuid"}, Token: 7, Expires: time.Now().Add(time.Minute)})
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	_, err = os.Stat(lock.leaseFile(7))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// a lease that has expired isn't renewed, as another host may have
+	// taken it over
+	lock.held = &lease{Holder: lockHolder{UUID: testCronnerUUID}, Token: 10, Expires: time.Now().Add(-time.Second)}
+
+	ok, err = lock.renew()
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	_, err = os.Stat(lock.leaseFile(10))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// and one that's no longer the latest isn't either
+	lock.held = &lease{Holder: lockHolder{UUID: testCronnerUUID}, Token: 8, Expires: time.Now().Add(time.Minute)}
+
+	ok, err = lock.renew()
+	c.Assert(err, IsNil)
+	c.Check(ok, Equals, false)
+
+	current, err = readLease(lock.leaseFile(8))
+	c.Assert(err, IsNil)
+	c.Check(current.Expires.Before(time.Now()), Equals, true)
+}
+
+func (*TestSuite) Test_handleCommand_leaseLock(c *C) {
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     c.MkDir(),
+			Lock:        true,
+			LockBackend: lockBackendLease,
+			LockTTL:     30,
+			FailEvent:   true,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "echo $CRONNER_FENCING_TOKEN"),
+	}
+
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "1\n")
+
+	h.cmd = exec.Command("/bin/sh", "-c", "echo $CRONNER_FENCING_TOKEN")
+
+	retCode, out, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "2\n")
+}
@@ -0,0 +1,159 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// rlimitUnlimited is the value of a resource limit that doesn't limit anything
+const rlimitUnlimited = math.MaxUint64
+
+// rlimitFlags are the --limit-* flags, along with the resource each one
+// limits and whether its value is a size in bytes
+var rlimitFlags = []struct {
+	flag     string
+	resource int
+	sized    bool
+	value    func(*binArgs) string
+}{
+	{"limit-as", rlimitAS, true, func(a *binArgs) string { return a.LimitAS }},
+	{"limit-core", syscall.RLIMIT_CORE, true, func(a *binArgs) string { return a.LimitCore }},
+	{"limit-cpu", syscall.RLIMIT_CPU, false, func(a *binArgs) string { return a.LimitCPU }},
+	{"limit-nofile", syscall.RLIMIT_NOFILE, false, func(a *binArgs) string { return a.LimitNofile }},
+	{"limit-nproc", rlimitNproc, false, func(a *binArgs) string { return a.LimitNproc }},
+}
+
+// rlimit is a resource limit to set on the command
+type rlimit struct {
+	resource int
+	value    uint64
+}
+
+// flag returns the --limit-* flag for the resource
+func (l rlimit) flag() string {
+	for _, f := range rlimitFlags {
+		if f.resource == l.resource {
+			return f.flag
+		}
+	}
+
+	return fmt.Sprintf("resource limit %d", l.resource)
+}
+
+// sys returns the soft and hard limits to set. They're the same, other than
+// for the CPU time: the command is sent SIGXCPU when it reaches the soft limit,
+// which can be caught to clean up, and SIGKILL when it reaches the hard limit,
+// so the hard limit is a second later.
+func (l rlimit) sys() *syscall.Rlimit {
+	rlim := newSysRlimit(l.value)
+
+	if l.resource == syscall.RLIMIT_CPU && l.value != rlimitUnlimited {
+		rlim.Max++
+	}
+
+	return rlim
+}
+
+// set sets the resource limit on the current process
+func (l rlimit) set() error {
+	if err := syscall.Setrlimit(l.resource, l.sys()); err != nil {
+		return fmt.Errorf("failed to set --%v: %v", l.flag(), err)
+	}
+
+	return nil
+}
+
+// parseRlimits parses the --limit-* flags that were given
+func parseRlimits(a *binArgs) ([]rlimit, error) {
+	var limits []rlimit
+
+	for _, f := range rlimitFlags {
+		s := f.value(a)
+
+		if len(s) == 0 {
+			continue
+		}
+
+		if f.resource < 0 {
+			return nil, fmt.Errorf("--%v isn't supported on this platform", f.flag)
+		}
+
+		value, err := parseLimitValue(s, f.sized)
+		if err != nil {
+			return nil, fmt.Errorf("--%v value '%v' is invalid, %v", f.flag, s, err)
+		}
+
+		limits = append(limits, rlimit{resource: f.resource, value: value})
+	}
+
+	return limits, nil
+}
+
+// parseLimitValue parses the value of a --limit-* flag, which is a number or
+// unlimited; sizes can have a K, M, G, or T suffix
+func parseLimitValue(s string, sized bool) (uint64, error) {
+	s = strings.ToLower(s)
+
+	if s == "unlimited" {
+		return rlimitUnlimited, nil
+	}
+
+	var multiplier uint64 = 1
+
+	if sized && len(s) > 0 {
+		if i := strings.IndexByte("kmgt", s[len(s)-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || n > rlimitUnlimited/multiplier {
+		if sized {
+			return 0, fmt.Errorf("it must be a number of bytes, with an optional K, M, G, or T suffix, or unlimited")
+		}
+
+		return 0, fmt.Errorf("it must be a number or unlimited")
+	}
+
+	return n * multiplier, nil
+}
+
+// limitKill returns why the command was killed, if it was killed for reaching
+// its --limit-cpu, or an empty string if it wasn't. The other limits make
+// whatever the command tries to do fail rather than kill it.
+func limitKill(opts *binArgs, state *os.ProcessState) string {
+	if state == nil {
+		return ""
+	}
+
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+
+	for _, l := range opts.Limits {
+		if l.resource != syscall.RLIMIT_CPU || l.value == rlimitUnlimited {
+			continue
+		}
+
+		cpuSecs := uint64((state.UserTime() + state.SystemTime()) / time.Second)
+
+		// SIGKILL is also sent by others, so only count it if the CPU
+		// time says it was for the limit
+		if status.Signal() == syscall.SIGXCPU || (status.Signal() == syscall.SIGKILL && cpuSecs >= l.value) {
+			return fmt.Sprintf("killed by %v for reaching --limit-cpu of %d seconds", signalName(status.Signal()), l.value)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,14 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import "syscall"
+
+const (
+	rlimitAS = syscall.RLIMIT_AS
+
+	// rlimitNproc is RLIMIT_NPROC, which the syscall package doesn't have
+	rlimitNproc = 6
+)
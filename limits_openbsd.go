@@ -0,0 +1,13 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+const (
+	// rlimitAS is -1, as OpenBSD doesn't limit the address space
+	rlimitAS = -1
+
+	// rlimitNproc is RLIMIT_NPROC, which the syscall package doesn't have
+	rlimitNproc = 7
+)
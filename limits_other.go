@@ -0,0 +1,17 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+//
+// +build !linux,!openbsd
+
+package main
+
+import "syscall"
+
+const (
+	rlimitAS = syscall.RLIMIT_AS
+
+	// rlimitNproc is RLIMIT_NPROC, which the syscall package doesn't have;
+	// this is its value on macOS and the BSDs
+	rlimitNproc = 7
+)
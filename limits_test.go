@@ -0,0 +1,146 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_parseRlimits(c *C) {
+	if rlimitAS < 0 {
+		c.Skip("the address space can't be limited on this platform")
+	}
+
+	limits, err := parseRlimits(&binArgs{})
+	c.Assert(err, IsNil)
+	c.Check(limits, HasLen, 0)
+
+	limits, err = parseRlimits(&binArgs{
+		LimitAS:     "2G",
+		LimitCore:   "0",
+		LimitCPU:    "60",
+		LimitNofile: "1024",
+		LimitNproc:  "Unlimited",
+	})
+	c.Assert(err, IsNil)
+	c.Check(limits, DeepEquals, []rlimit{
+		{resource: rlimitAS, value: 2 << 30},
+		{resource: syscall.RLIMIT_CORE, value: 0},
+		{resource: syscall.RLIMIT_CPU, value: 60},
+		{resource: syscall.RLIMIT_NOFILE, value: 1024},
+		{resource: rlimitNproc, value: rlimitUnlimited},
+	})
+
+	// the CPU time gets a second to clean up after SIGXCPU
+	c.Check(limits[2].sys(), DeepEquals, &syscall.Rlimit{Cur: 60, Max: 61})
+	c.Check(limits[3].sys(), DeepEquals, &syscall.Rlimit{Cur: 1024, Max: 1024})
+
+	_, err = parseRlimits(&binArgs{LimitNofile: "1k"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--limit-nofile value '1k' is invalid, it must be a number or unlimited")
+
+	_, err = parseRlimits(&binArgs{LimitAS: "lots"})
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "--limit-as value 'lots' is invalid, it must be a number of bytes, with an optional K, M, G, or T suffix, or unlimited")
+
+	_, err = parseRlimits(&binArgs{LimitAS: "99999999999T"})
+	c.Assert(err, Not(IsNil))
+}
+
+func (*TestSuite) Test_handleCommand_limits(c *C) {
+	limits, err := parseRlimits(&binArgs{LimitNofile: "64", LimitCore: "0"})
+	c.Assert(err, IsNil)
+
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			FailEvent: true,
+			Limits:    limits,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "ulimit -n; ulimit -c; echo $0"),
+	}
+
+	// the limits are set in the command's process, which looks no different
+	// to the command
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "64\n0\n/bin/sh\n")
+	c.Check(h.cmd.Path, Equals, "/bin/sh")
+
+	// being killed for reaching the CPU time limit
+	h.opts.Limits, err = parseRlimits(&binArgs{LimitCPU: "1"})
+	c.Assert(err, IsNil)
+
+	h.cmd = exec.Command("/bin/sh", "-c", "while :; do :; done")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Not(Equals), 0)
+
+	var body string
+
+	for _, e := range r.emissions {
+		if e.kind == "event" {
+			body = e.body
+		}
+	}
+
+	c.Check(strings.Contains(body, "\nresource limit: killed by SIGXCPU for reaching --limit-cpu of 1 seconds\n"), Equals, true, Commentf("body: %q", body))
+}
+
+func (*TestSuite) Test_execHelper(c *C) {
+	c.Check(execHelperArgs(&binArgs{}), HasLen, 0)
+	c.Check(execHelperArgs(&binArgs{Limits: []rlimit{{resource: 7, value: 64}}}), DeepEquals, []string{"--rlimit", "7:64"})
+
+	cred, err := parseHelperCredential(helperCredential(&syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{4, 27}}))
+	c.Assert(err, IsNil)
+	c.Check(cred, DeepEquals, &syscall.Credential{Uid: 65534, Gid: 65534, Groups: []uint32{4, 27}})
+
+	cred, err = parseHelperCredential("0:0:")
+	c.Assert(err, IsNil)
+	c.Check(cred, DeepEquals, &syscall.Credential{Groups: []uint32{}})
+
+	_, err = parseHelperCredential("0:root:")
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "invalid exec helper credential '0:root:'")
+
+	l, err := parseHelperLimit("7:64")
+	c.Assert(err, IsNil)
+	c.Check(l, Equals, rlimit{resource: 7, value: 64})
+
+	_, err = parseHelperLimit("7")
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "invalid exec helper resource limit '7'")
+
+	// the helper only returns when something went wrong
+	tests := []struct {
+		args []string
+		msg  string
+	}{
+		{[]string{"--rlimit", "bogus", "--", "/bin/true", "true"}, "cronner: invalid exec helper resource limit 'bogus'\n"},
+		{[]string{"--bogus", "1", "--", "/bin/true", "true"}, "cronner: unknown exec helper option --bogus\n"},
+		{[]string{"--rlimit", "7:64", "--"}, "cronner: the exec helper needs a command to run\n"},
+		{[]string{"--rlimit"}, "cronner: exec helper option --rlimit is missing its value\n"},
+		{[]string{"--", "/nonexistent", "nonexistent"}, "cronner: failed to run '/nonexistent': no such file or directory\n"},
+	}
+
+	for _, test := range tests {
+		var stderr bytes.Buffer
+
+		c.Check(execHelper(test.args, &stderr), Equals, intErrCode)
+		c.Check(stderr.String(), Equals, test.msg)
+	}
+}
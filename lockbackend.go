@@ -0,0 +1,197 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/theckman/go-flock"
+	"github.com/tideland/golib/logger"
+)
+
+const (
+	lockBackendFlock = "flock"
+	lockBackendRedis = "redis"
+	lockBackendLease = "lease"
+)
+
+// lockPollInterval is how often a lock that can't be waited on is checked,
+// while waiting for it
+var lockPollInterval = time.Millisecond * 250
+
+// fencingTokenEnvVar is the environment variable the fencing token of the lock
+// is passed to the command in, for the backends that have them
+const fencingTokenEnvVar = "CRONNER_FENCING_TOKEN"
+
+// jobLock is the lock that keeps more than one run of a job from running at the
+// same time with --lock; which backend is used is picked with --lock-backend
+type jobLock interface {
+	// tryLock makes a single attempt at getting the lock
+	tryLock() (bool, error)
+
+	// waitLock waits until the lock is obtained, or until the deadline
+	// passes, with a zero deadline waiting forever; with fifo the waiters
+	// get the lock in the order they started waiting, if the backend
+	// supports it
+	waitLock(deadline time.Time, fifo bool) (bool, error)
+
+	// unlock releases the lock
+	unlock() error
+
+	// holderDetail returns the details of who is holding the lock, to add
+	// to an error message, or an empty string if they aren't known
+	holderDetail() string
+
+	// fencingToken returns the token of this holding of the lock, which is
+	// larger every time the lock is obtained, and whether the backend has
+	// them
+	fencingToken() (int64, bool)
+
+	// kind is what the lock is called in messages, like "file lock"
+	kind() string
+
+	String() string
+}
+
+// newJobLock returns the lock for the job, using the --lock-backend backend
+func newJobLock(hndlr *cmdHandler) (jobLock, error) {
+	switch hndlr.opts.LockBackend {
+	case lockBackendRedis:
+		lock, err := newRedisLock(hndlr)
+		if err != nil {
+			return nil, err
+		}
+
+		return lock, nil
+	case lockBackendLease:
+		return newLeaseLock(hndlr), nil
+	default:
+		return &flockLock{
+			Flock:  flock.NewFlock(path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.lock", hndlr.opts.Label))),
+			holder: newLockHolder(hndlr),
+			hndlr:  hndlr,
+		}, nil
+	}
+}
+
+// pollLock waits for a lock that can't be waited on by trying to get it every
+// lockPollInterval, until the deadline passes; a zero deadline waits forever
+func pollLock(lock jobLock, deadline time.Time) (bool, error) {
+	for {
+		locked, err := lock.tryLock()
+		if err != nil || locked {
+			return locked, err
+		}
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return false, nil
+		}
+
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// renewLock calls renew every third of the TTL of a lock that expires, to push
+// back its expiry, until stop is closed. If renew says the lock is no longer
+// held, because it expired before it could be renewed, it gives up. done is
+// closed when it returns.
+func renewLock(lock jobLock, hndlr *cmdHandler, ttl time.Duration, renew func() (bool, error), stop, done chan struct{}) {
+	defer close(done)
+
+	tick := time.NewTicker(ttl / 3)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+			held, err := renew()
+			if err != nil {
+				// the lock may still be held, so try again next time
+				logger.Errorf("failed to renew lock '%v': %v", lock, err)
+				continue
+			}
+
+			if !held {
+				logger.Errorf("lost lock '%v', another run of %v may start", lock, hndlr.opts.Label)
+				hndlr.emitter.Count(fmt.Sprintf("%v.lock_lost", hndlr.opts.Label), 1, metricTags(hndlr))
+				return
+			}
+		}
+	}
+}
+
+// flockLock is the default lock backend, a file lock in the lock directory;
+// it only keeps runs on the same host from running at the same time
+type flockLock struct {
+	*flock.Flock
+	holder *lockHolder
+	hndlr  *cmdHandler
+}
+
+func (l *flockLock) tryLock() (bool, error) {
+	locked, err := l.TryLock()
+
+	if locked {
+		l.obtained()
+	}
+
+	return locked, err
+}
+
+func (l *flockLock) waitLock(deadline time.Time, fifo bool) (bool, error) {
+	var locked bool
+	var err error
+
+	if fifo {
+		locked, err = waitLockFIFO(l.Flock, deadline)
+	} else {
+		locked, err = waitLock(l.Flock, deadline)
+	}
+
+	if locked {
+		l.obtained()
+	}
+
+	return locked, err
+}
+
+// obtained leaves a note of who is holding the lock, for anyone else trying to
+// get it, and hands the lock file over to the command's user if it runs as
+// someone else
+func (l *flockLock) obtained() {
+	l.holder.Start = time.Now()
+
+	if err := chownToCommand(l.hndlr, l.Path()); err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	if err := writeLockHolder(l.Path(), l.holder); err != nil {
+		logger.Errorf("%v", err)
+	}
+}
+
+func (l *flockLock) unlock() error {
+	if err := removeLockHolder(l.Path()); err != nil {
+		logger.Errorf("%v", err)
+	}
+
+	return l.Unlock()
+}
+
+func (l *flockLock) holderDetail() string {
+	return lockHolderDetail(l.Path())
+}
+
+func (l *flockLock) fencingToken() (int64, bool) {
+	return 0, false
+}
+
+func (l *flockLock) kind() string {
+	return "file lock"
+}
@@ -0,0 +1,226 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+const (
+	lockFilePrefix   = "cronner-"
+	lockFileSuffix   = ".lock"
+	holderFileSuffix = ".holder"
+)
+
+// lockHolder is who is holding a lock. It's written to a holder file next to
+// the lock file while the lock is held, as the lock file itself is truncated
+// by every process trying to take the lock.
+type lockHolder struct {
+	PID      int       `json:"pid"`
+	UUID     string    `json:"uuid"`
+	Label    string    `json:"label"`
+	Hostname string    `json:"hostname"`
+	Command  string    `json:"command"`
+	Start    time.Time `json:"start"`
+}
+
+// newLockHolder returns the lockHolder for this invocation of cronner
+func newLockHolder(hndlr *cmdHandler) *lockHolder {
+	return &lockHolder{
+		PID:      os.Getpid(),
+		UUID:     hndlr.uuid,
+		Label:    hndlr.opts.Label,
+		Hostname: hndlr.hostname,
+		Command:  commandLine(hndlr),
+		Start:    time.Now(),
+	}
+}
+
+func (h *lockHolder) String() string {
+	return fmt.Sprintf(
+		"pid %d on %v, uuid %v, held for %v: %v",
+		h.PID, h.Hostname, h.UUID, time.Since(h.Start).Truncate(time.Second), h.Command,
+	)
+}
+
+// holderFilename returns the path of the holder file of the lock file
+func holderFilename(lockFilename string) string {
+	return strings.TrimSuffix(lockFilename, lockFileSuffix) + holderFileSuffix
+}
+
+// writeLockHolder writes the holder file of the lock file; it's written to a
+// temporary file which is then renamed, so that a reader never sees half of it
+func writeLockHolder(lockFilename string, h *lockHolder) error {
+	contents, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode lock holder: %v", err)
+	}
+
+	return writeFileAtomic(holderFilename(lockFilename), append(contents, '\n'), 0600)
+}
+
+// readLockHolder reads the holder file of the lock file
+func readLockHolder(lockFilename string) (*lockHolder, error) {
+	contents, err := ioutil.ReadFile(holderFilename(lockFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	h := &lockHolder{}
+
+	if err = json.Unmarshal(contents, h); err != nil {
+		return nil, fmt.Errorf("failed to parse lock holder file '%v': %v", holderFilename(lockFilename), err)
+	}
+
+	return h, nil
+}
+
+// removeLockHolder removes the holder file of the lock file; it's done before
+// unlocking, so that the next holder's file can't be removed by mistake
+func removeLockHolder(lockFilename string) error {
+	if err := os.Remove(holderFilename(lockFilename)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock holder file: %v", err)
+	}
+
+	return nil
+}
+
+// lockHolderDetail returns the details of who is holding the lock, to add to
+// an error message, or an empty string if they aren't known
+func lockHolderDetail(lockFilename string) string {
+	h, err := readLockHolder(lockFilename)
+	if err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%v)", h)
+}
+
+// heldLock is a lock found by the locks subcommand
+type heldLock struct {
+	lockFile string
+	holder   *lockHolder
+
+	// stale is whether the holder file was left behind by a process that's
+	// no longer running, like one that was sent a SIGKILL
+	stale bool
+}
+
+// findLocks returns the locks in dir that have a holder file, oldest first
+func findLocks(dir string) ([]heldLock, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list lock directory '%v': %v", dir, err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	var locks []heldLock
+
+	for _, file := range files {
+		name := file.Name()
+
+		if !strings.HasPrefix(name, lockFilePrefix) || !strings.HasSuffix(name, holderFileSuffix) {
+			continue
+		}
+
+		lockFile := path.Join(dir, strings.TrimSuffix(name, holderFileSuffix)+lockFileSuffix)
+
+		h, err := readLockHolder(lockFile)
+		if err != nil {
+			// it was removed since listing the directory
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		locks = append(locks, heldLock{
+			lockFile: lockFile,
+			holder:   h,
+			stale:    h.Hostname == hostname && !processExists(h.PID),
+		})
+	}
+
+	sort.SliceStable(locks, func(i, j int) bool { return locks[i].holder.Start.Before(locks[j].holder.Start) })
+
+	return locks, nil
+}
+
+// processExists returns whether a process with the pid is running on this host
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// printLocks writes the locks to w as a table, with the age of each holder as
+// of now
+func printLocks(w io.Writer, locks []heldLock, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "LOCK\tLABEL\tPID\tHOST\tAGE\tUUID\tCOMMAND")
+
+	for _, l := range locks {
+		h := l.holder
+		age := now.Sub(h.Start).Truncate(time.Second).String()
+
+		if l.stale {
+			age += " (stale)"
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%d\t%v\t%v\t%v\t%v\n", path.Base(l.lockFile), h.Label, h.PID, h.Hostname, age, h.UUID, h.Command)
+	}
+
+	return tw.Flush()
+}
+
+// locksArgs are the arguments of the locks subcommand
+type locksArgs struct {
+	LockDir string `short:"d" long:"lock-dir" default:"/var/lock" description:"the directory where lock files are placed"`
+}
+
+// locksCmd is the locks subcommand, which lists the cronner locks that are
+// currently held, and who is holding them; it returns the exit code
+func locksCmd(args []string, stdout, stderr io.Writer) int {
+	l := &locksArgs{}
+
+	p := flags.NewParser(l, flags.HelpFlag)
+	p.Name = "cronner locks"
+
+	if _, err := p.ParseArgs(args); err != nil {
+		if errType, ok := err.(*flags.Error); ok && errType.Type == flags.ErrHelp {
+			fmt.Fprint(stdout, err.Error())
+			return 0
+		}
+
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	locks, err := findLocks(l.LockDir)
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	if err = printLocks(stdout, locks, time.Now()); err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,180 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/theckman/go-flock"
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_lockHolder(c *C) {
+	lockFile := path.Join(c.MkDir(), "cronner-testCmd.lock")
+
+	c.Check(holderFilename(lockFile), Equals, strings.TrimSuffix(lockFile, ".lock")+".holder")
+
+	// no holder file
+	_, err := readLockHolder(lockFile)
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(lockHolderDetail(lockFile), Equals, "")
+	c.Check(removeLockHolder(lockFile), IsNil)
+
+	h := &lockHolder{
+		PID:      1234,
+		UUID:     testCronnerUUID,
+		Label:    "testCmd",
+		Hostname: "brainbox01",
+		Command:  "/bin/sleep 60",
+		Start:    time.Now().Add(-time.Minute * 2),
+	}
+
+	c.Assert(writeLockHolder(lockFile, h), IsNil)
+
+	read, err := readLockHolder(lockFile)
+	c.Assert(err, IsNil)
+	c.Check(read.PID, Equals, 1234)
+	c.Check(read.UUID, Equals, testCronnerUUID)
+	c.Check(read.Command, Equals, "/bin/sleep 60")
+	c.Check(read.Start.Equal(h.Start), Equals, true)
+
+	c.Check(lockHolderDetail(lockFile), Equals, fmt.Sprintf(" (pid 1234 on brainbox01, uuid %v, held for 2m0s: /bin/sleep 60)", testCronnerUUID))
+
+	c.Assert(removeLockHolder(lockFile), IsNil)
+	c.Check(lockHolderDetail(lockFile), Equals, "")
+}
+
+func (*TestSuite) Test_handleCommand_lockHolder(c *C) {
+	lockDir := c.MkDir()
+	lockFile := path.Join(lockDir, "cronner-testCmd.lock")
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			LockDir:   lockDir,
+			Lock:      true,
+			FailEvent: true,
+		},
+		cmd: exec.Command("/bin/sh", "-c", fmt.Sprintf("cat %v", holderFilename(lockFile))),
+	}
+
+	// the command sees the holder file while it's running
+	_, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(out), fmt.Sprintf(`"pid":%d`, os.Getpid())), Equals, true)
+	c.Check(strings.Contains(string(out), fmt.Sprintf(`"uuid":"%v"`, testCronnerUUID)), Equals, true)
+
+	c.Check(strings.Contains(string(out), fmt.Sprintf(`"command":"/bin/sh -c cat %v"`, holderFilename(lockFile))), Equals, true)
+
+	// and it's gone once the lock is released
+	_, err = os.Stat(holderFilename(lockFile))
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// the arguments may hold secrets, so they're left out with --sensitive
+	h.opts.Sensitive = true
+	h.cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf("cat %v", holderFilename(lockFile)))
+
+	_, out, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(out), `"command":"/bin/sh"`), Equals, true)
+
+	h.opts.Sensitive = false
+
+	// failing to get the lock says who is holding it
+	lf := flock.NewFlock(lockFile)
+
+	locked, err := lf.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	defer lf.Unlock()
+
+	c.Assert(writeLockHolder(lockFile, &lockHolder{
+		PID:      1234,
+		UUID:     "other-uuid",
+		Hostname: "brainbox02",
+		Command:  "/bin/sleep 60",
+		Start:    time.Now(),
+	}), IsNil)
+
+	h.cmd = exec.Command("/bin/true")
+
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, fmt.Sprintf("failed to obtain lock on '%v': locked by another process (pid 1234 on brainbox02, uuid other-uuid, held for 0s: /bin/sleep 60)", lockFile))
+
+	// the holder file of the other process is left alone
+	_, err = os.Stat(holderFilename(lockFile))
+	c.Check(err, IsNil)
+}
+
+func (*TestSuite) Test_locksCmd(c *C) {
+	dir := c.MkDir()
+	hostname, err := os.Hostname()
+	c.Assert(err, IsNil)
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	c.Assert(writeLockHolder(path.Join(dir, "cronner-backup.lock"), &lockHolder{
+		PID:      os.Getpid(),
+		UUID:     "uuid1",
+		Label:    "backup",
+		Hostname: hostname,
+		Command:  "/usr/local/bin/backup --full",
+		Start:    now.Add(-time.Hour*3 - time.Millisecond*1500),
+	}), IsNil)
+
+	// a process that doesn't exist anymore
+	dead := exec.Command("/bin/true")
+	c.Assert(dead.Run(), IsNil)
+
+	c.Assert(writeLockHolder(path.Join(dir, "cronner-report.slot-1.lock"), &lockHolder{
+		PID:      dead.Process.Pid,
+		UUID:     "uuid2",
+		Label:    "report",
+		Hostname: hostname,
+		Command:  "/bin/report",
+		Start:    now.Add(-time.Minute * 5),
+	}), IsNil)
+
+	locks, err := findLocks(dir)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 2)
+
+	c.Check(locks[0].lockFile, Equals, path.Join(dir, "cronner-backup.lock"))
+	c.Check(locks[0].stale, Equals, false)
+	c.Check(locks[1].lockFile, Equals, path.Join(dir, "cronner-report.slot-1.lock"))
+	c.Check(locks[1].stale, Equals, true)
+
+	var stdout, stderr bytes.Buffer
+
+	c.Assert(printLocks(&stdout, locks, now), IsNil)
+	lines := strings.Split(stdout.String(), "\n")
+	c.Assert(lines, HasLen, 4)
+	c.Check(strings.Fields(lines[0]), DeepEquals, []string{"LOCK", "LABEL", "PID", "HOST", "AGE", "UUID", "COMMAND"})
+	c.Check(strings.Fields(lines[1]), DeepEquals, []string{
+		"cronner-backup.lock", "backup", fmt.Sprint(os.Getpid()), hostname, "3h0m1s", "uuid1", "/usr/local/bin/backup", "--full",
+	})
+	c.Check(strings.Fields(lines[2]), DeepEquals, []string{
+		"cronner-report.slot-1.lock", "report", fmt.Sprint(dead.Process.Pid), hostname, "5m0s", "(stale)", "uuid2", "/bin/report",
+	})
+
+	stdout.Reset()
+	c.Check(locksCmd([]string{"--lock-dir", dir}, &stdout, &stderr), Equals, 0)
+	c.Check(stderr.String(), Equals, "")
+	c.Check(strings.Count(stdout.String(), "\n"), Equals, 3)
+
+	c.Check(locksCmd([]string{"--lock-dir", path.Join(dir, "missing")}, &stdout, &stderr), Equals, 1)
+	c.Check(strings.HasPrefix(stderr.String(), "error: failed to list lock directory"), Equals, true)
+}
@@ -0,0 +1,208 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theckman/go-flock"
+)
+
+const (
+	onLockedFail  = "fail"
+	onLockedSkip  = "skip"
+	onLockedQueue = "queue"
+)
+
+// lockBusyError is the error when the lock, or every one of the slots, is held
+// by other runs of the job
+type lockBusyError struct {
+	msg string
+}
+
+func (e *lockBusyError) Error() string {
+	return e.msg
+}
+
+// isLockBusy returns whether err is because the lock is held by another run
+func isLockBusy(err error) bool {
+	_, ok := err.(*lockBusyError)
+	return ok
+}
+
+// waitLock blocks until the lock is obtained, or until the deadline passes; it
+// returns whether the lock was obtained. A zero deadline waits forever.
+func waitLock(lock *flock.Flock, deadline time.Time) (bool, error) {
+	result := make(chan error, 1)
+
+	go func() { result <- lock.Lock() }()
+
+	var timeout <-chan time.Time
+
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-result:
+		return err == nil, err
+	case <-timeout:
+		// there's no way to stop waiting for a file lock, so let it go as
+		// soon as it's obtained
+		go func() {
+			if <-result == nil {
+				lock.Unlock()
+			}
+		}()
+
+		return false, nil
+	}
+}
+
+// With --lock-fifo the processes waiting for a lock form a queue, so that they
+// get it in the order they started waiting. Each waiter takes a numbered
+// ticket, which is a file it holds a lock on while waiting, and waits for the
+// ticket before its own to be given up before waiting for the lock itself.
+//
+// The ticket lock being released by the kernel when a waiter dies means that a
+// waiter that was killed doesn't hold up the rest of the queue.
+
+// ticketPrefix returns the prefix of the ticket file names for the lock file
+func ticketPrefix(lockFilename string) string {
+	return strings.TrimSuffix(lockFilename, lockFileSuffix) + ".ticket-"
+}
+
+// queuedTickets returns the numbers of the tickets in the queue for the lock
+// file, in order
+func queuedTickets(lockFilename string) ([]int, error) {
+	prefix := ticketPrefix(lockFilename)
+
+	files, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the lock queue: %v", err)
+	}
+
+	var tickets []int
+
+	for _, file := range files {
+		if n, err := strconv.Atoi(strings.TrimPrefix(file, prefix)); err == nil {
+			tickets = append(tickets, n)
+		}
+	}
+
+	sort.Ints(tickets)
+
+	return tickets, nil
+}
+
+// takeTicket joins the back of the queue for the lock file, returning the lock
+// on the ticket and its number
+func takeTicket(lockFilename string) (*flock.Flock, int, error) {
+	guard := flock.NewFlock(strings.TrimSuffix(lockFilename, lockFileSuffix) + ".queue.lock")
+
+	if err := guard.Lock(); err != nil {
+		return nil, 0, fmt.Errorf("failed to lock the queue '%v': %v", guard, err)
+	}
+
+	defer guard.Unlock()
+
+	tickets, err := queuedTickets(lockFilename)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var n int
+
+	if len(tickets) > 0 {
+		n = tickets[len(tickets)-1] + 1
+	}
+
+	ticket := flock.NewFlock(ticketPrefix(lockFilename) + strconv.Itoa(n))
+
+	locked, err := ticket.TryLock()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to lock ticket '%v': %v", ticket, err)
+	}
+
+	if !locked {
+		return nil, 0, fmt.Errorf("failed to lock ticket '%v': locked by another process", ticket)
+	}
+
+	return ticket, n, nil
+}
+
+// waitTurn waits until there are no tickets ahead of ticket n in the queue for
+// the lock file, or until the deadline passes; it returns whether it's now the
+// turn of ticket n
+func waitTurn(lockFilename string, n int, deadline time.Time) (bool, error) {
+	for {
+		tickets, err := queuedTickets(lockFilename)
+		if err != nil {
+			return false, err
+		}
+
+		ahead := -1
+
+		for _, t := range tickets {
+			if t < n {
+				ahead = t
+			}
+		}
+
+		if ahead < 0 {
+			return true, nil
+		}
+
+		// wait for the ticket just ahead of this one to be given up, which
+		// is when its waiter gets the lock, times out, or dies
+		prev := flock.NewFlock(ticketPrefix(lockFilename) + strconv.Itoa(ahead))
+
+		locked, err := waitLock(prev, deadline)
+		if err != nil {
+			return false, fmt.Errorf("failed to wait for ticket '%v': %v", prev, err)
+		}
+
+		if !locked {
+			return false, nil
+		}
+
+		// clean up after a waiter that died, and go around again in case
+		// there's still someone ahead of it
+		os.Remove(prev.Path())
+		prev.Unlock()
+	}
+}
+
+// waitLockFIFO waits in the queue for the lock, and then for the lock itself,
+// until the deadline passes; it returns whether the lock was obtained
+func waitLockFIFO(lock *flock.Flock, deadline time.Time) (bool, error) {
+	ticket, n, err := takeTicket(lock.Path())
+	if err != nil {
+		return false, err
+	}
+
+	// give up the ticket once we're done waiting, letting the next one in
+	// the queue know it's their turn
+	defer func() {
+		os.Remove(ticket.Path())
+		ticket.Unlock()
+	}()
+
+	ok, err := waitTurn(lock.Path(), n, deadline)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return waitLock(lock, deadline)
+}
@@ -0,0 +1,204 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/theckman/go-flock"
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_waitLock(c *C) {
+	lockFile := path.Join(c.MkDir(), "cronner-testCmd.lock")
+
+	held := flock.NewFlock(lockFile)
+
+	locked, err := held.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	// timing out
+	lock := flock.NewFlock(lockFile)
+
+	start := time.Now()
+	locked, err = waitLock(lock, start.Add(time.Millisecond*200))
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, false)
+	c.Check(time.Since(start) < time.Second, Equals, true)
+
+	// the lock is obtained as soon as it's released, rather than on the
+	// next poll
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		held.Unlock()
+	}()
+
+	lock = flock.NewFlock(lockFile)
+
+	start = time.Now()
+	locked, err = waitLock(lock, start.Add(time.Second*5))
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, true)
+	c.Check(time.Since(start) < time.Millisecond*500, Equals, true)
+	c.Check(lock.Unlock(), IsNil)
+}
+
+func (*TestSuite) Test_waitLockFIFO(c *C) {
+	lockFile := path.Join(c.MkDir(), "cronner-testCmd.lock")
+
+	held := flock.NewFlock(lockFile)
+
+	locked, err := held.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	// a ticket left behind by a waiter that died doesn't hold up the queue
+	stale := flock.NewFlock(ticketPrefix(lockFile) + "0")
+	c.Assert(stale.Lock(), IsNil)
+	c.Assert(stale.Unlock(), IsNil)
+
+	order := make(chan int, 3)
+	deadline := time.Now().Add(time.Second * 10)
+
+	for i := 1; i <= 3; i++ {
+		go func(i int) {
+			lock := flock.NewFlock(lockFile)
+
+			locked, err := waitLockFIFO(lock, deadline)
+			if err != nil || !locked {
+				order <- -1
+				return
+			}
+
+			order <- i
+
+			time.Sleep(time.Millisecond * 50)
+			lock.Unlock()
+		}(i)
+
+		// let each waiter take its ticket before the next one starts
+		for {
+			tickets, err := queuedTickets(lockFile)
+			c.Assert(err, IsNil)
+
+			if len(tickets) > 0 && tickets[len(tickets)-1] == i {
+				break
+			}
+
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+
+	c.Assert(held.Unlock(), IsNil)
+
+	c.Check([]int{<-order, <-order, <-order}, DeepEquals, []int{1, 2, 3})
+
+	// all of the tickets were cleaned up
+	tickets, err := queuedTickets(lockFile)
+	c.Assert(err, IsNil)
+	c.Check(tickets, HasLen, 0)
+
+	// timing out gives up the ticket
+	c.Assert(held.Lock(), IsNil)
+
+	locked, err = waitLockFIFO(flock.NewFlock(lockFile), time.Now().Add(time.Millisecond*200))
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, false)
+
+	_, err = os.Stat(ticketPrefix(lockFile) + "0")
+	c.Check(os.IsNotExist(err), Equals, true)
+	c.Check(held.Unlock(), IsNil)
+}
+
+func (*TestSuite) Test_handleCommand_onLocked(c *C) {
+	lockDir := c.MkDir()
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			LockDir:   lockDir,
+			Lock:      true,
+			AllEvents: true,
+			OnLocked:  onLockedSkip,
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	held := flock.NewFlock(path.Join(lockDir, "cronner-testCmd.lock"))
+
+	locked, err := held.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	// skipping a run isn't a failure
+	retCode, _, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+
+	c.Assert(r.emissions, HasLen, 3)
+	c.Check(r.emissions[1], DeepEquals, emission{kind: "count", name: "testCmd.skipped", value: 1, tags: []string{}})
+	c.Check(r.emissions[2].kind, Equals, "event")
+	c.Check(r.emissions[2].name, Equals, "Cron testCmd skipped on brainbox01, previous run still active")
+	c.Check(r.emissions[2].body, Equals, fmt.Sprintf("UUID: %v\nfailed to obtain lock on '%v': locked by another process\n", testCronnerUUID, held))
+
+	// the same goes for the slots
+	h.opts.Lock = false
+	h.opts.AllEvents = false
+	h.opts.MaxConcurrent = 1
+	r.emissions = nil
+
+	slot := flock.NewFlock(slotLockPath(h, 0))
+
+	locked, err = slot.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(r.emissions, DeepEquals, []emission{{kind: "count", name: "testCmd.skipped", value: 1, tags: []string{}}})
+
+	c.Assert(slot.Unlock(), IsNil)
+
+	// queueing waits for the lock without a limit
+	h.opts.Lock = true
+	h.opts.MaxConcurrent = 0
+	h.opts.OnLocked = onLockedQueue
+	h.cmd = exec.Command("/bin/true")
+	r.emissions = nil
+
+	go func() {
+		time.Sleep(time.Millisecond * 200)
+		held.Unlock()
+	}()
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Assert(len(r.emissions) > 0, Equals, true)
+	c.Check(r.emissions[0].name, Equals, "testCmd.lock_wait")
+	c.Check(r.emissions[0].value >= 200, Equals, true)
+
+	// failing is still the default
+	c.Assert(held.Lock(), IsNil)
+
+	h.opts.OnLocked = onLockedFail
+	h.cmd = exec.Command("/bin/true")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(isLockBusy(err), Equals, true)
+	c.Check(retCode, Equals, 200)
+	c.Check(held.Unlock(), IsNil)
+}
@@ -0,0 +1,183 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tideland/golib/logger"
+)
+
+// webhookRetryDelay is how long to wait before retrying a failed webhook
+var webhookRetryDelay = time.Second
+
+// notification is what's sent to the webhooks when a job finishes; it's also
+// the JSON payload of the generic webhook
+type notification struct {
+	Title     string   `json:"title"`
+	Label     string   `json:"label"`
+	Group     string   `json:"group,omitempty"`
+	Hostname  string   `json:"hostname"`
+	UUID      string   `json:"uuid"`
+	AlertType string   `json:"alert_type"`
+	ExitCode  int      `json:"exit_code"`
+	Duration  float64  `json:"duration_seconds"`
+	Attempts  int      `json:"attempts"`
+	Output    string   `json:"output"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// notifier is something that can be told about the outcome of a job
+type notifier interface {
+	notify(n *notification) error
+}
+
+// newNotifiers builds the notifiers asked for on the command line
+func newNotifiers(opts *binArgs) []notifier {
+	var notifiers []notifier
+
+	client := &http.Client{Timeout: time.Second * time.Duration(opts.WebhookTimeout)}
+
+	if len(opts.WebhookURL) > 0 {
+		notifiers = append(notifiers, &webhookNotifier{url: opts.WebhookURL, client: client, retries: opts.WebhookRetries})
+	}
+
+	if len(opts.SlackWebhookURL) > 0 {
+		notifiers = append(notifiers, &slackNotifier{webhookNotifier{url: opts.SlackWebhookURL, client: client, retries: opts.WebhookRetries}})
+	}
+
+	return notifiers
+}
+
+// sendNotifications tells all of the handler's notifiers about the outcome of
+// the job; failures are logged, as they shouldn't change the job's result
+func sendNotifications(hndlr *cmdHandler, n *notification) {
+	for _, nt := range hndlr.notifiers {
+		if err := nt.notify(n); err != nil {
+			logger.Errorf("%v", err)
+		}
+	}
+}
+
+// webhookNotifier POSTs the notification as JSON to a URL
+type webhookNotifier struct {
+	url     string
+	client  *http.Client
+	retries uint64
+}
+
+func (w *webhookNotifier) notify(n *notification) error {
+	return w.post(n)
+}
+
+// post sends payload as JSON, retrying up to w.retries times if the request
+// fails or the server responds with a 5xx or 429 status code
+func (w *webhookNotifier) post(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to build webhook payload: %v", err)
+	}
+
+	for attempt := uint64(0); ; attempt++ {
+		retry, err := w.postOnce(body)
+
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= w.retries {
+			return err
+		}
+
+		time.Sleep(webhookRetryDelay)
+	}
+}
+
+// postOnce makes a single attempt at sending body, and returns whether it's
+// worth trying again if it failed
+func (w *webhookNotifier) postOnce(body []byte) (bool, error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, fmt.Errorf("failed to send webhook: %v", err)
+	}
+
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("failed to send webhook: %v responded with %v", w.url, resp.Status)
+
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// slackNotifier sends the notification to a Slack incoming webhook
+type slackNotifier struct {
+	webhookNotifier
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields"`
+}
+
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+// slackColors maps the alert types to the colors of the Slack attachment
+var slackColors = map[string]string{
+	"success": "good",
+	"warning": "warning",
+	"error":   "danger",
+}
+
+// slackCodeEscaper escapes the characters Slack treats as markup even in a
+// code block, so that the output can't mention anyone or show links, and
+// breaks up any backticks in it with zero-width spaces, so that it can't close
+// the code block it's shown in
+var slackCodeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "`", "`\u200b")
+
+func (s *slackNotifier) notify(n *notification) error {
+	attachment := slackAttachment{
+		Fallback: n.Title,
+		Color:    slackColors[n.AlertType],
+		Fields: []slackField{
+			{Title: "Host", Value: n.Hostname, Short: true},
+			{Title: "UUID", Value: n.UUID, Short: true},
+			{Title: "Exit Code", Value: fmt.Sprintf("%d", n.ExitCode), Short: true},
+			{Title: "Duration", Value: fmt.Sprintf("%.5f seconds", n.Duration), Short: true},
+		},
+	}
+
+	if n.Attempts > 1 {
+		attachment.Fields = append(attachment.Fields, slackField{Title: "Attempts", Value: fmt.Sprintf("%d", n.Attempts), Short: true})
+	}
+
+	if len(n.Output) > 0 {
+		attachment.Text = fmt.Sprintf("```%v```", slackCodeEscaper.Replace(n.Output))
+	}
+
+	return s.post(&slackPayload{Text: n.Title, Attachments: []slackAttachment{attachment}})
+}
@@ -0,0 +1,219 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// webhookServer is an httptest server that records the bodies POSTed to it,
+// and responds with each of the status codes in turn before responding 200
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests [][]byte
+}
+
+func newWebhookServer(statuses ...int) *webhookServer {
+	w := &webhookServer{statuses: statuses}
+
+	w.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		w.requests = append(w.requests, body)
+
+		if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(w.statuses) > 0 {
+			rw.WriteHeader(w.statuses[0])
+			w.statuses = w.statuses[1:]
+		}
+	}))
+
+	return w
+}
+
+func (w *webhookServer) bodies() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.requests
+}
+
+func (*TestSuite) Test_webhookNotifier(c *C) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	n := &notification{
+		Title:     "Cron testCmd failed in 1.00000 seconds on brainbox01",
+		Label:     "testCmd",
+		Hostname:  "brainbox01",
+		UUID:      testCronnerUUID,
+		AlertType: "error",
+		ExitCode:  1,
+		Duration:  1,
+		Attempts:  1,
+		Output:    "oops\n",
+	}
+
+	// a server error is retried
+	srv := newWebhookServer(http.StatusInternalServerError)
+	defer srv.Close()
+
+	opts := &binArgs{WebhookURL: srv.URL, WebhookTimeout: 5, WebhookRetries: 2}
+
+	notifiers := newNotifiers(opts)
+	c.Assert(notifiers, HasLen, 1)
+	c.Assert(notifiers[0].notify(n), IsNil)
+
+	bodies := srv.bodies()
+	c.Assert(bodies, HasLen, 2)
+	c.Check(string(bodies[0]), Equals, string(bodies[1]))
+
+	var payload map[string]interface{}
+	c.Assert(json.Unmarshal(bodies[1], &payload), IsNil)
+	c.Check(payload["title"], Equals, n.Title)
+	c.Check(payload["label"], Equals, "testCmd")
+	c.Check(payload["hostname"], Equals, "brainbox01")
+	c.Check(payload["uuid"], Equals, testCronnerUUID)
+	c.Check(payload["alert_type"], Equals, "error")
+	c.Check(payload["exit_code"], Equals, float64(1))
+	c.Check(payload["duration_seconds"], Equals, float64(1))
+	c.Check(payload["output"], Equals, "oops\n")
+
+	// giving up after the retries are exhausted
+	srv = newWebhookServer(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	defer srv.Close()
+
+	opts.WebhookURL = srv.URL
+	err := newNotifiers(opts)[0].notify(n)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, fmt.Sprintf("failed to send webhook: %v responded with 502 Bad Gateway", srv.URL))
+	c.Check(srv.bodies(), HasLen, 3)
+
+	// a client error isn't retried
+	srv = newWebhookServer(http.StatusNotFound)
+	defer srv.Close()
+
+	opts.WebhookURL = srv.URL
+	c.Check(newNotifiers(opts)[0].notify(n), Not(IsNil))
+	c.Check(srv.bodies(), HasLen, 1)
+}
+
+func (*TestSuite) Test_slackNotifier(c *C) {
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	notifiers := newNotifiers(&binArgs{SlackWebhookURL: srv.URL, WebhookTimeout: 5})
+	c.Assert(notifiers, HasLen, 1)
+
+	err := notifiers[0].notify(&notification{
+		Title:     "Cron testCmd succeeded in 0.50000 seconds on brainbox01",
+		Hostname:  "brainbox01",
+		UUID:      testCronnerUUID,
+		AlertType: "success",
+		Duration:  0.5,
+		Attempts:  2,
+		Output:    "ok\n",
+	})
+	c.Assert(err, IsNil)
+
+	bodies := srv.bodies()
+	c.Assert(bodies, HasLen, 1)
+
+	var payload slackPayload
+	c.Assert(json.Unmarshal(bodies[0], &payload), IsNil)
+	c.Check(payload.Text, Equals, "Cron testCmd succeeded in 0.50000 seconds on brainbox01")
+	c.Assert(payload.Attachments, HasLen, 1)
+	c.Check(payload.Attachments[0].Color, Equals, "good")
+	c.Check(payload.Attachments[0].Text, Equals, "```ok\n```")
+	c.Check(payload.Attachments[0].Fields, DeepEquals, []slackField{
+		{Title: "Host", Value: "brainbox01", Short: true},
+		{Title: "UUID", Value: testCronnerUUID, Short: true},
+		{Title: "Exit Code", Value: "0", Short: true},
+		{Title: "Duration", Value: "0.50000 seconds", Short: true},
+		{Title: "Attempts", Value: "2", Short: true},
+	})
+
+	// backticks in the output can't end the code block early, and it can't
+	// mention anyone or show links
+	err = notifiers[0].notify(&notification{
+		Title:     "Cron testCmd failed in 0.50000 seconds on brainbox01",
+		AlertType: "error",
+		Output:    "```\n*@channel* `x`\n<!channel> <@U123> <http://x|y> a && b",
+	})
+	c.Assert(err, IsNil)
+
+	bodies = srv.bodies()
+	c.Assert(bodies, HasLen, 2)
+
+	payload = slackPayload{}
+	c.Assert(json.Unmarshal(bodies[1], &payload), IsNil)
+	c.Assert(payload.Attachments, HasLen, 1)
+	c.Check(payload.Attachments[0].Text, Equals, "```"+"`\u200b`\u200b`\u200b\n*@channel* `\u200bx`\u200b\n&lt;!channel&gt; &lt;@U123&gt; &lt;http://x|y&gt; a &amp;&amp; b"+"```")
+	c.Check(strings.Count(payload.Attachments[0].Text, "```"), Equals, 2)
+}
+
+func (*TestSuite) Test_handleCommand_notifications(c *C) {
+	srv := newWebhookServer()
+	defer srv.Close()
+
+	opts := &binArgs{
+		Label:          "testCmd",
+		FailEvent:      true,
+		WebhookURL:     srv.URL,
+		WebhookTimeout: 5,
+	}
+
+	h := &cmdHandler{
+		emitter:   &recordingEmitter{},
+		notifiers: newNotifiers(opts),
+		hostname:  "brainbox01",
+		uuid:      testCronnerUUID,
+		opts:      opts,
+		cmd:       exec.Command("/bin/sh", "-c", "echo nope; exit 2"),
+	}
+
+	retCode, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 2)
+
+	bodies := srv.bodies()
+	c.Assert(bodies, HasLen, 1)
+
+	var n notification
+	c.Assert(json.Unmarshal(bodies[0], &n), IsNil)
+	c.Check(n.Label, Equals, "testCmd")
+	c.Check(n.UUID, Equals, testCronnerUUID)
+	c.Check(n.AlertType, Equals, "error")
+	c.Check(n.ExitCode, Equals, 2)
+	c.Check(n.Attempts, Equals, 1)
+	c.Check(n.Output, Equals, "nope\n")
+
+	// like the completion event, nothing is sent on success with -E
+	h.cmd = exec.Command("/bin/true")
+
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(srv.bodies(), HasLen, 1)
+}
@@ -0,0 +1,379 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/tideland/golib/logger"
+)
+
+const (
+	eventOutputCombined = "combined"
+	eventOutputStdout   = "stdout"
+	eventOutputStderr   = "stderr"
+	eventOutputBoth     = "both"
+)
+
+// logTimestampFormat is the fixed-width timestamp prepended to each line of the
+// per-stream log files, so that they can be merged back together in order
+// with something like `sort -m`
+const logTimestampFormat = "2006-01-02T15:04:05.000000000Z"
+
+// maxStreamSection is how much of each stream is included in the completion
+// event when both are shown, leaving room for the rest of the event body
+const maxStreamSection = (MaxBody - 512) / 2
+
+// timestampWriter prefixes every line written through it with the time
+type timestampWriter struct {
+	w       io.Writer
+	midLine bool
+}
+
+func (t *timestampWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	ts := []byte(time.Now().UTC().Format(logTimestampFormat) + " ")
+
+	for len(p) > 0 {
+		if !t.midLine {
+			if _, err := t.w.Write(ts); err != nil {
+				return 0, err
+			}
+		}
+
+		line := p
+		i := bytes.IndexByte(p, '\n')
+
+		if i >= 0 {
+			line = p[:i+1]
+		}
+
+		if _, err := t.w.Write(line); err != nil {
+			return 0, err
+		}
+
+		t.midLine = i < 0
+		p = p[len(line):]
+	}
+
+	return n, nil
+}
+
+// commandOutput sets up where the output of the command goes, and keeps track
+// of it for the completion event and the -F/--log-fail files
+//
+// by default stdout and stderr are captured together, but with --event-output
+// they're captured separately; in that case the log files are also split, with
+// each line prefixed by a timestamp
+type commandOutput struct {
+	opts  *binArgs
+	split bool
+
+	// bounded is whether only the head and tail of the output is kept
+	bounded bool
+
+	combined        outputBuffer
+	combinedCapture *outputCapture
+
+	stdout, stderr       outputBuffer
+	stdoutLog, stderrLog *timestampWriter
+	stdoutSpill          *outputCapture
+	stderrSpill          *outputCapture
+}
+
+func newBuffer(opts *binArgs) outputBuffer {
+	if opts.OutputHead > 0 || opts.OutputTail > 0 {
+		return newOutputCapture(int(opts.OutputHead), int(opts.OutputTail))
+	}
+
+	return &bytes.Buffer{}
+}
+
+func newCommandOutput(opts *binArgs) *commandOutput {
+	o := &commandOutput{
+		opts:    opts,
+		split:   opts.EventOutput != "" && opts.EventOutput != eventOutputCombined,
+		bounded: opts.OutputHead > 0 || opts.OutputTail > 0,
+	}
+
+	if o.split {
+		o.stdout = newBuffer(opts)
+		o.stderr = newBuffer(opts)
+	} else {
+		o.combined = newBuffer(opts)
+		o.combinedCapture, _ = o.combined.(*outputCapture)
+	}
+
+	return o
+}
+
+// attach sets the stdout and stderr of the command
+func (o *commandOutput) attach(cmd *exec.Cmd) {
+	// setup multiple streams only on passthru
+	// capture the output only if we actually plan on using it
+	// otherwise, /dev/null
+	if !o.opts.AllEvents && !o.opts.FailEvent && !o.opts.LogFail {
+		if o.opts.Passthru {
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+		} else {
+			cmd.Stdout = nil
+			cmd.Stderr = nil
+		}
+
+		return
+	}
+
+	if !o.split {
+		// combine stdout and stderr to the same buffer
+		if o.opts.Passthru {
+			cmd.Stdout = io.MultiWriter(os.Stdout, o.combined)
+			cmd.Stderr = io.MultiWriter(os.Stderr, o.combined)
+		} else {
+			cmd.Stdout = o.combined
+			cmd.Stderr = o.combined
+		}
+
+		return
+	}
+
+	stdout := []io.Writer{o.stdout}
+	stderr := []io.Writer{o.stderr}
+
+	if o.opts.Passthru {
+		stdout = append(stdout, os.Stdout)
+		stderr = append(stderr, os.Stderr)
+	}
+
+	if o.stdoutLog != nil {
+		stdout = append(stdout, o.stdoutLog)
+	}
+
+	if o.stderrLog != nil {
+		stderr = append(stderr, o.stderrLog)
+	}
+
+	cmd.Stdout = io.MultiWriter(stdout...)
+	cmd.Stderr = io.MultiWriter(stderr...)
+}
+
+// logFilename returns the name of the -F/--log-fail file for the stream
+func logFilename(hndlr *cmdHandler, stream string) string {
+	if stream == "" {
+		return path.Join(hndlr.opts.LogPath, fmt.Sprintf("%v-%v.out", hndlr.opts.Label, hndlr.uuid))
+	}
+
+	return path.Join(hndlr.opts.LogPath, fmt.Sprintf("%v-%v.%v.log", hndlr.opts.Label, hndlr.uuid, stream))
+}
+
+// openSpill creates a spill file next to where the log file will end up
+func openSpill(capture *outputCapture, filename string) bool {
+	dir, file := path.Split(filename)
+
+	if err := capture.openSpill(path.Join(dir, fmt.Sprintf(".%v.spill", file))); err != nil {
+		logger.Errorf("failed to create spill file, only the captured output will be saved: %v", err)
+		return false
+	}
+
+	return true
+}
+
+// openLogs starts streaming the output to disk for -F/--log-fail, which is
+// needed when only part of the output is kept in memory or when the streams
+// are split; it needs to be called before attach
+func (o *commandOutput) openLogs(hndlr *cmdHandler) {
+	if !o.opts.LogFail {
+		return
+	}
+
+	if !o.split {
+		if o.combinedCapture != nil {
+			openSpill(o.combinedCapture, logFilename(hndlr, ""))
+		}
+		return
+	}
+
+	o.stdoutSpill = newOutputCapture(0, 0)
+	if openSpill(o.stdoutSpill, logFilename(hndlr, eventOutputStdout)) {
+		o.stdoutLog = &timestampWriter{w: o.stdoutSpill}
+	}
+
+	o.stderrSpill = newOutputCapture(0, 0)
+	if openSpill(o.stderrSpill, logFilename(hndlr, eventOutputStderr)) {
+		o.stderrLog = &timestampWriter{w: o.stderrSpill}
+	}
+}
+
+// reset throws away the output captured so far, so that only the output of the
+// most recent attempt is kept
+func (o *commandOutput) reset() {
+	for _, b := range []outputBuffer{o.combined, o.stdout, o.stderr} {
+		if b != nil {
+			b.Reset()
+		}
+	}
+
+	for _, l := range []*timestampWriter{o.stdoutLog, o.stderrLog} {
+		if l != nil {
+			l.midLine = false
+		}
+	}
+
+	for _, s := range []*outputCapture{o.stdoutSpill, o.stderrSpill} {
+		if s != nil {
+			s.Reset()
+		}
+	}
+}
+
+// size returns the total size of the output, including anything that was
+// elided; it's only known when the output is bounded
+func (o *commandOutput) size() (int64, bool) {
+	if !o.bounded {
+		return 0, false
+	}
+
+	if !o.split {
+		return o.combinedCapture.Len(), true
+	}
+
+	return o.stdout.(*outputCapture).Len() + o.stderr.(*outputCapture).Len(), true
+}
+
+// bytes returns the output as shown in the completion event; with both streams
+// selected, stderr comes first
+func (o *commandOutput) bytes() []byte {
+	switch {
+	case !o.split:
+		return o.combined.Bytes()
+	case o.opts.EventOutput == eventOutputStdout:
+		return o.stdout.Bytes()
+	case o.opts.EventOutput == eventOutputStderr:
+		return o.stderr.Bytes()
+	default:
+		return append(o.stderr.Bytes(), o.stdout.Bytes()...)
+	}
+}
+
+// tailOutput returns the last max bytes of out, prefixed with "...\n" if any
+// of it was cut off
+func tailOutput(out []byte, max int) string {
+	if len(out) > max {
+		return "...\n" + string(out[len(out)-max:])
+	}
+
+	return string(out)
+}
+
+// outputSection formats one stream of the output for the completion event,
+// keeping only the last max bytes of it if max is greater than zero
+func outputSection(name string, out []byte, max int) string {
+	if len(out) == 0 {
+		return fmt.Sprintf("%v: (none)\n", name)
+	}
+
+	section := string(out)
+
+	if max > 0 {
+		section = tailOutput(out, max)
+	}
+
+	if section[len(section)-1] != '\n' {
+		section += "\n"
+	}
+
+	return fmt.Sprintf("%v: %v", name, section)
+}
+
+// eventBody returns the output section of the completion event
+//
+// when both streams are shown stderr comes first, and each stream is limited
+// to its tail so that one of them can't crowd the other out of the event
+func (o *commandOutput) eventBody() string {
+	switch {
+	case !o.split:
+		out := o.combined.Bytes()
+		if len(out) == 0 {
+			return "output: (none)"
+		}
+		return fmt.Sprintf("output: %s", out)
+	case o.opts.EventOutput == eventOutputStdout:
+		return outputSection(eventOutputStdout, o.stdout.Bytes(), 0)
+	case o.opts.EventOutput == eventOutputStderr:
+		return outputSection(eventOutputStderr, o.stderr.Bytes(), 0)
+	default:
+		return outputSection(eventOutputStderr, o.stderr.Bytes(), maxStreamSection) +
+			outputSection(eventOutputStdout, o.stdout.Bytes(), maxStreamSection)
+	}
+}
+
+// saveLogs writes the -F/--log-fail files, moving the spill files into place
+// if there are any, and returns whether it was successful
+func (o *commandOutput) saveLogs(hndlr *cmdHandler) bool {
+	if !o.split {
+		filename := logFilename(hndlr, "")
+
+		if o.combinedCapture != nil && o.combinedCapture.spilling() {
+			if err := o.combinedCapture.keepSpill(filename); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return bailOut(o.bytes(), hndlr.opts.Sensitive)
+			}
+			return true
+		}
+
+		return writeOutput(filename, o.combined.Bytes(), hndlr.opts.Sensitive)
+	}
+
+	streams := []struct {
+		name  string
+		spill *outputCapture
+		buf   outputBuffer
+	}{
+		{eventOutputStdout, o.stdoutSpill, o.stdout},
+		{eventOutputStderr, o.stderrSpill, o.stderr},
+	}
+
+	for _, s := range streams {
+		filename := logFilename(hndlr, s.name)
+
+		if s.spill != nil && s.spill.spilling() {
+			if err := s.spill.keepSpill(filename); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				return bailOut(s.buf.Bytes(), hndlr.opts.Sensitive)
+			}
+			continue
+		}
+
+		if !writeOutput(filename, s.buf.Bytes(), hndlr.opts.Sensitive) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// logFiles returns the names of the files saveLogs writes
+func (o *commandOutput) logFiles(hndlr *cmdHandler) []string {
+	if !o.split {
+		return []string{logFilename(hndlr, "")}
+	}
+
+	return []string{logFilename(hndlr, eventOutputStdout), logFilename(hndlr, eventOutputStderr)}
+}
+
+// close removes any spill files that weren't kept
+func (o *commandOutput) close() {
+	for _, s := range []*outputCapture{o.combinedCapture, o.stdoutSpill, o.stderrSpill} {
+		if s != nil {
+			s.removeSpill()
+		}
+	}
+}
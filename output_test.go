@@ -0,0 +1,148 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_timestampWriter(c *C) {
+	var buf bytes.Buffer
+
+	w := &timestampWriter{w: &buf}
+
+	n, err := w.Write([]byte("one\ntw"))
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, 6)
+
+	_, err = w.Write([]byte("o\nthree\n"))
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(buf.String(), "\n")
+	c.Assert(lines, HasLen, 4)
+	c.Check(lines[3], Equals, "")
+
+	tsRegex := regexp.MustCompile(`^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{9}Z `)
+
+	for i, expected := range []string{"one", "two", "three"} {
+		c.Check(tsRegex.MatchString(lines[i]), Equals, true)
+		c.Check(lines[i][len(logTimestampFormat)+1:], Equals, expected)
+	}
+}
+
+func (*TestSuite) Test_commandOutput_eventBody(c *C) {
+	opts := &binArgs{EventOutput: eventOutputCombined}
+
+	o := newCommandOutput(opts)
+	c.Check(o.split, Equals, false)
+	c.Check(o.eventBody(), Equals, "output: (none)")
+
+	o.combined.Write([]byte("out\nerr\n"))
+	c.Check(o.eventBody(), Equals, "output: out\nerr\n")
+
+	opts.EventOutput = eventOutputStdout
+	o = newCommandOutput(opts)
+	c.Check(o.split, Equals, true)
+
+	o.stdout.Write([]byte("out"))
+	o.stderr.Write([]byte("err\n"))
+	c.Check(o.eventBody(), Equals, "stdout: out\n")
+	c.Check(string(o.bytes()), Equals, "out")
+
+	opts.EventOutput = eventOutputStderr
+	c.Check(o.eventBody(), Equals, "stderr: err\n")
+	c.Check(string(o.bytes()), Equals, "err\n")
+
+	opts.EventOutput = eventOutputBoth
+	c.Check(o.eventBody(), Equals, "stderr: err\nstdout: out\n")
+	c.Check(string(o.bytes()), Equals, "err\nout")
+
+	o.reset()
+	c.Check(o.eventBody(), Equals, "stderr: (none)\nstdout: (none)\n")
+
+	// each stream only gets its tail when both are shown
+	o.stderr.Write(bytes.Repeat([]byte("e"), maxStreamSection+10))
+	o.stdout.Write([]byte("out\n"))
+
+	body := o.eventBody()
+	c.Check(len(body) < MaxBody, Equals, true)
+	c.Check(strings.HasPrefix(body, "stderr: ...\neee"), Equals, true)
+	c.Check(strings.HasSuffix(body, "eee\nstdout: out\n"), Equals, true)
+}
+
+func (*TestSuite) Test_handleCommand_eventOutput(c *C) {
+	r := &recordingEmitter{}
+	logDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     c.MkDir(),
+			LogPath:     logDir,
+			FailEvent:   true,
+			LogFail:     true,
+			EventOutput: eventOutputBoth,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "echo out1; echo err1 >&2; echo out2; exit 3"),
+	}
+
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 3)
+	c.Check(string(out), Equals, "err1\nout1\nout2\n")
+
+	c.Assert(r.emissions, HasLen, 3)
+	c.Check(r.emissions[2].kind, Equals, "event")
+	c.Check(r.emissions[2].body, Equals, fmt.Sprintf("UUID: %v\nexit code: 3\nstderr: err1\nstdout: out1\nout2\n", testCronnerUUID))
+
+	// each stream is logged to its own file, and no spill files are left
+	files, err := ioutil.ReadDir(logDir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	c.Check(files[0].Name(), Equals, fmt.Sprintf("testCmd-%v.stderr.log", testCronnerUUID))
+	c.Check(files[1].Name(), Equals, fmt.Sprintf("testCmd-%v.stdout.log", testCronnerUUID))
+
+	for i, expected := range []string{"err1\n", "out1\nout2\n"} {
+		c.Check(files[i].Mode(), Equals, os.FileMode(0400))
+
+		contents, err := ioutil.ReadFile(path.Join(logDir, files[i].Name()))
+		c.Assert(err, IsNil)
+
+		var stripped []string
+		for _, line := range strings.SplitAfter(string(contents), "\n") {
+			if len(line) > len(logTimestampFormat) {
+				stripped = append(stripped, line[len(logTimestampFormat)+1:])
+			}
+		}
+
+		c.Check(strings.Join(stripped, ""), Equals, expected)
+	}
+
+	//
+	// Test that the log files are removed if the command succeeds
+	//
+	h.uuid = "2b4cd3b8-a1b3-4b43-9d6e-7c9b1e9ce3a4"
+	h.cmd = exec.Command("/bin/sh", "-c", "echo out; echo err >&2")
+
+	_, out, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(string(out), Equals, "err\nout\n")
+
+	files, err = ioutil.ReadDir(logDir)
+	c.Assert(err, IsNil)
+	c.Check(files, HasLen, 2)
+}
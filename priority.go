@@ -0,0 +1,84 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// The scheduling priorities are set in the exec helper, before it runs the
+// command. Both the niceness and the I/O priority belong to the thread that
+// sets them, which is the thread that then execs the command.
+
+const (
+	ioniceClassRealtime   = "realtime"
+	ioniceClassBestEffort = "best-effort"
+	ioniceClassIdle       = "idle"
+)
+
+// ioprioClasses are the I/O scheduling classes of ioprio_set(2), by the names
+// --ionice-class takes
+var ioprioClasses = map[string]int{
+	ioniceClassRealtime:   1,
+	ioniceClassBestEffort: 2,
+	ioniceClassIdle:       3,
+}
+
+// ioprioClassShift is how far the class is shifted in an I/O priority, with
+// the level in the bits below it
+const ioprioClassShift = 13
+
+// validatePriority checks the --nice, --ionice-class, and --ionice-level
+// values; the class is lowercased
+func validatePriority(opts *binArgs) error {
+	if opts.Nice < -20 || opts.Nice > 19 {
+		return fmt.Errorf("--nice value '%d' is invalid, it must be from -20 to 19", opts.Nice)
+	}
+
+	if len(opts.IoniceClass) > 0 {
+		if !ioprioSupported {
+			return fmt.Errorf("--ionice-class is only supported on Linux")
+		}
+
+		opts.IoniceClass = strings.ToLower(opts.IoniceClass)
+
+		if _, ok := ioprioClasses[opts.IoniceClass]; !ok {
+			return fmt.Errorf("%v is not a known I/O scheduling class, try realtime, best-effort, or idle", opts.IoniceClass)
+		}
+	}
+
+	if opts.IoniceLevel < 0 || opts.IoniceLevel > 7 {
+		return fmt.Errorf("--ionice-level value '%d' is invalid, it must be from 0 to 7", opts.IoniceLevel)
+	}
+
+	return nil
+}
+
+// ioprio returns the I/O priority for ioprio_set(2) from the --ionice-class
+// and --ionice-level, or -1 if --ionice-class wasn't given; the idle class
+// doesn't have levels
+func ioprio(opts *binArgs) int {
+	class, ok := ioprioClasses[opts.IoniceClass]
+	if !ok {
+		return -1
+	}
+
+	if opts.IoniceClass == ioniceClassIdle {
+		return class << ioprioClassShift
+	}
+
+	return class<<ioprioClassShift | opts.IoniceLevel
+}
+
+// setNice sets the niceness of the calling thread
+func setNice(nice int) error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice); err != nil {
+		return fmt.Errorf("failed to set --nice %d: %v", nice, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_ioprio(c *C) {
+	c.Check(ioprio(&binArgs{IoniceLevel: 4}), Equals, -1)
+	c.Check(ioprio(&binArgs{IoniceClass: "realtime", IoniceLevel: 0}), Equals, 1<<13)
+	c.Check(ioprio(&binArgs{IoniceClass: "best-effort", IoniceLevel: 7}), Equals, 2<<13|7)
+
+	// the idle class has no levels
+	c.Check(ioprio(&binArgs{IoniceClass: "idle", IoniceLevel: 4}), Equals, 3<<13)
+
+	c.Check(execHelperArgs(&binArgs{Nice: 10, IoniceClass: "idle"}), DeepEquals, []string{"--nice", "10", "--ioprio", "24576"})
+}
+
+func (*TestSuite) Test_handleCommand_priority(c *C) {
+	if runtime.GOOS != "linux" {
+		c.Skip("I/O priorities are only supported on Linux")
+	}
+
+	if _, err := exec.LookPath("ionice"); err != nil {
+		c.Skip("ionice isn't installed")
+	}
+
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			FailEvent:   true,
+			Nice:        5,
+			IoniceClass: "best-effort",
+			IoniceLevel: 6,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "nice; ionice -p $$"),
+	}
+
+	// the priorities are set in the command's process, and the command is
+	// still what cronner reports on
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "5\nbest-effort: prio 6\n")
+	c.Check(h.cmd.Path, Equals, "/bin/sh")
+
+	h.opts.Nice, h.opts.IoniceClass = 0, "idle"
+	h.cmd = exec.Command("/bin/sh", "-c", "nice; ionice -p $$")
+
+	retCode, out, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "0\nidle\n")
+}
+
+func (*TestSuite) Test_handleCommand_priorityUser(c *C) {
+	if runtime.GOOS != "linux" {
+		c.Skip("I/O priorities are only supported on Linux")
+	}
+
+	if os.Getuid() != 0 {
+		c.Skip("running the command as another user needs root")
+	}
+
+	if _, err := exec.LookPath("ionice"); err != nil {
+		c.Skip("ionice isn't installed")
+	}
+
+	if _, err := user.Lookup("nobody"); err != nil {
+		c.Skip("there is no nobody user")
+	}
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			FailEvent:   true,
+			User:        "nobody",
+			Nice:        -5,
+			IoniceClass: "realtime",
+			IoniceLevel: 3,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "nice; ionice -p $$"),
+	}
+
+	// the priorities that need root are set before the user is switched to
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "-5\nrealtime: prio 3\n")
+}
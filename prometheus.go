@@ -0,0 +1,205 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/theckman/go-flock"
+)
+
+const (
+	promRunsTotal     = "cronner_runs_total"
+	promFailuresTotal = "cronner_failures_total"
+	promLastSuccess   = "cronner_last_success_timestamp_seconds"
+)
+
+var promLabelNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// promPrevious is the state carried over from the previous textfile for the
+// same label, so that counters keep increasing across runs
+type promPrevious struct {
+	runs        float64
+	failures    float64
+	lastSuccess float64
+}
+
+// promTextfileName returns the path of the textfile for the job
+func promTextfileName(hndlr *cmdHandler) string {
+	return path.Join(hndlr.opts.PromTextfileDir, fmt.Sprintf("cronner_%v.prom", hndlr.opts.Label))
+}
+
+// promLockName returns the path of the lock file for the textfile; it's hidden
+// so that the textfile collector doesn't look at it
+func promLockName(filename string) string {
+	dir, file := path.Split(filename)
+	return path.Join(dir, fmt.Sprintf(".%v.lock", file))
+}
+
+// promEscape escapes a label value as required by the Prometheus text format
+func promEscape(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// promLabels builds the label set for the job's samples: the label and group,
+// plus any <key>:<value> tags. Tags without a value can't be represented as a
+// Prometheus label so they are left out. A label can only be in a sample once,
+// so when tags have the same key, once it's been made a valid label name, the
+// last of them wins.
+func promLabels(hndlr *cmdHandler) string {
+	labels := []string{fmt.Sprintf(`label="%s"`, promEscape(hndlr.opts.Label))}
+
+	if len(hndlr.opts.Group) > 0 {
+		labels = append(labels, fmt.Sprintf(`group="%s"`, promEscape(hndlr.opts.Group)))
+	}
+
+	var keys []string
+	values := make(map[string]string)
+
+	for _, tag := range hndlr.opts.Tags {
+		i := strings.Index(tag, ":")
+		if i < 1 {
+			continue
+		}
+
+		key := promLabelNameRegex.ReplaceAllString(tag[:i], "_")
+
+		if key == "label" || key == "group" {
+			continue
+		}
+
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		values[key] = tag[i+1:]
+	}
+
+	for _, key := range keys {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, key, promEscape(values[key])))
+	}
+
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// readPromPrevious parses the counters out of the previous textfile; it's not
+// an error for the file to not exist
+func readPromPrevious(filename string) (promPrevious, error) {
+	var prev promPrevious
+
+	file, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return prev, nil
+		}
+		return prev, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, promRunsTotal+"{"):
+			prev.runs = value
+		case strings.HasPrefix(line, promFailuresTotal+"{"):
+			prev.failures = value
+		case strings.HasPrefix(line, promLastSuccess+"{"):
+			prev.lastSuccess = value
+		}
+	}
+
+	return prev, scanner.Err()
+}
+
+// promTimestamp formats a time.Time as Unix seconds
+func promTimestamp(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// writePromTextfile writes the results of the run for the node_exporter
+// textfile collector. The file is written to a temporary file in the same
+// directory first, and then renamed into place, so the collector never reads
+// a partially written file.
+//
+// The textfile is locked while its counters are read and updated, as runs of
+// the job can finish at the same time when they aren't run with --lock, or
+// with --max-concurrent, and would otherwise lose each other's increments.
+func writePromTextfile(hndlr *cmdHandler, ret int, start, end time.Time) error {
+	filename := promTextfileName(hndlr)
+
+	lock := flock.NewFlock(promLockName(filename))
+
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to lock textfile '%v': %v", filename, err)
+	}
+
+	defer lock.Unlock()
+
+	prev, err := readPromPrevious(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read previous textfile '%v': %v", filename, err)
+	}
+
+	prev.runs++
+
+	if ret == 0 {
+		prev.lastSuccess = promTimestamp(end)
+	} else {
+		prev.failures++
+	}
+
+	labels := promLabels(hndlr)
+
+	var buf bytes.Buffer
+
+	samples := []struct {
+		name, kind, help string
+		value            float64
+	}{
+		{"cronner_last_exit_code", "gauge", "Exit code of the last run of the job.", float64(ret)},
+		{"cronner_last_duration_seconds", "gauge", "How long the last run of the job took.", end.Sub(start).Seconds()},
+		{"cronner_last_start_timestamp_seconds", "gauge", "When the last run of the job started.", promTimestamp(start)},
+		{"cronner_last_end_timestamp_seconds", "gauge", "When the last run of the job finished.", promTimestamp(end)},
+		{promLastSuccess, "gauge", "When the job last finished successfully.", prev.lastSuccess},
+		{promRunsTotal, "counter", "How many times the job has been run.", prev.runs},
+		{promFailuresTotal, "counter", "How many times the job has failed.", prev.failures},
+	}
+
+	for _, s := range samples {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", s.name, s.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", s.name, s.kind)
+		fmt.Fprintf(&buf, "%s%s %s\n", s.name, labels, strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+
+	return writeFileAtomic(filename, buf.Bytes(), 0644)
+}
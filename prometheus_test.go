@@ -0,0 +1,142 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_promLabels(c *C) {
+	h := &cmdHandler{
+		opts: &binArgs{
+			Label: "testCmd",
+			Group: `some"group`,
+			Tags:  []string{"env:prod", "novalue", "team-name:a:b", "label:ignored"},
+		},
+	}
+
+	c.Check(promLabels(h), Equals, `{label="testCmd",group="some\"group",env="prod",team_name="a:b"}`)
+
+	// tags with the same key, before or after it's made a valid label name,
+	// are only in the label set once
+	h.opts.Tags = []string{"role:a", "team-name:ops", "env:prod", "role:b", "team.name:dev"}
+	c.Check(promLabels(h), Equals, `{label="testCmd",group="some\"group",role="b",team_name="dev",env="prod"}`)
+}
+
+func (*TestSuite) Test_writePromTextfile(c *C) {
+	dir := c.MkDir()
+
+	h := &cmdHandler{
+		opts: &binArgs{
+			Label:           "testCmd",
+			PromTextfileDir: dir,
+		},
+	}
+
+	start := time.Unix(1500000000, 0)
+	end := start.Add(time.Millisecond * 2500)
+
+	c.Assert(writePromTextfile(h, 0, start, end), IsNil)
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "cronner_testCmd.prom"))
+	c.Assert(err, IsNil)
+
+	lines := strings.Split(string(contents), "\n")
+	c.Check(lines[2], Equals, `cronner_last_exit_code{label="testCmd"} 0`)
+	c.Check(lines[5], Equals, `cronner_last_duration_seconds{label="testCmd"} 2.5`)
+	c.Check(lines[8], Equals, `cronner_last_start_timestamp_seconds{label="testCmd"} 1500000000`)
+	c.Check(lines[11], Equals, `cronner_last_end_timestamp_seconds{label="testCmd"} 1500000002.5`)
+	c.Check(lines[14], Equals, `cronner_last_success_timestamp_seconds{label="testCmd"} 1500000002.5`)
+	c.Check(lines[17], Equals, `cronner_runs_total{label="testCmd"} 1`)
+	c.Check(lines[20], Equals, `cronner_failures_total{label="testCmd"} 0`)
+
+	stat, err := os.Stat(path.Join(dir, "cronner_testCmd.prom"))
+	c.Assert(err, IsNil)
+	c.Check(stat.Mode(), Equals, os.FileMode(0644))
+
+	//
+	// Test that the counters and the last success are carried over
+	//
+	start = start.Add(time.Hour)
+	end = start.Add(time.Second)
+
+	c.Assert(writePromTextfile(h, 3, start, end), IsNil)
+
+	contents, err = ioutil.ReadFile(path.Join(dir, "cronner_testCmd.prom"))
+	c.Assert(err, IsNil)
+
+	lines = strings.Split(string(contents), "\n")
+	c.Check(lines[2], Equals, `cronner_last_exit_code{label="testCmd"} 3`)
+	c.Check(lines[14], Equals, `cronner_last_success_timestamp_seconds{label="testCmd"} 1500000002.5`)
+	c.Check(lines[17], Equals, `cronner_runs_total{label="testCmd"} 2`)
+	c.Check(lines[20], Equals, `cronner_failures_total{label="testCmd"} 1`)
+
+	// no temporary files are left behind, only the hidden lock file
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 2)
+	c.Check(files[0].Name(), Equals, ".cronner_testCmd.prom.lock")
+	c.Check(files[1].Name(), Equals, "cronner_testCmd.prom")
+
+	//
+	// Test that runs finishing at the same time don't lose each other's
+	// increments
+	//
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			c.Check(writePromTextfile(h, 0, start, end), IsNil)
+		}()
+	}
+
+	wg.Wait()
+
+	contents, err = ioutil.ReadFile(path.Join(dir, "cronner_testCmd.prom"))
+	c.Assert(err, IsNil)
+
+	lines = strings.Split(string(contents), "\n")
+	c.Check(lines[17], Equals, `cronner_runs_total{label="testCmd"} 22`)
+}
+
+func (t *TestSuite) Test_handleCommand_promTextfile(c *C) {
+	dir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  t.h.emitter,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:           "testCmd",
+			LockDir:         c.MkDir(),
+			LogPath:         c.MkDir(),
+			PromTextfileDir: dir,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "exit 2"),
+	}
+
+	_, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+
+	for i := 0; i < 2; i++ {
+		_, ok := <-t.out
+		c.Assert(ok, Equals, true)
+	}
+
+	contents, err := ioutil.ReadFile(path.Join(dir, "cronner_testCmd.prom"))
+	c.Assert(err, IsNil)
+	c.Check(strings.Contains(string(contents), "\ncronner_last_exit_code{label=\"testCmd\"} 2\n"), Equals, true)
+}
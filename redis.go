@@ -0,0 +1,197 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisClient is a minimal client for the Redis protocol (RESP), with just
+// enough of it for the redis lock backend. It's safe for concurrent use, and
+// reconnects on the next command after a connection error.
+type redisClient struct {
+	addr     string
+	password string
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// newRedisClient connects to the Redis server at addr, authenticating with the
+// password if it's not empty; timeout is used for connecting and for each
+// command
+func newRedisClient(addr, password string, timeout time.Duration) (*redisClient, error) {
+	c := &redisClient{addr: addr, password: password, timeout: timeout}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// connect opens the connection to the server; c.mu must be held
+func (c *redisClient) connect() error {
+	conn, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis at '%v': %v", c.addr, err)
+	}
+
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	if len(c.password) > 0 {
+		if _, err = c.roundTrip([]string{"AUTH", c.password}); err != nil {
+			c.disconnect()
+			return fmt.Errorf("failed to authenticate to redis at '%v': %v", c.addr, err)
+		}
+	}
+
+	return nil
+}
+
+// disconnect closes the connection to the server; c.mu must be held
+func (c *redisClient) disconnect() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn, c.r = nil, nil
+	}
+}
+
+// do runs a command, returning its reply: a string for simple and bulk
+// strings, an int64 for integers, nil for a null bulk string, or an
+// []interface{} of those for arrays. An error reply is returned as a
+// redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args)
+
+	if _, ok := err.(redisError); err != nil && !ok {
+		// the connection is in an unknown state
+		c.disconnect()
+	}
+
+	return reply, err
+}
+
+// roundTrip sends a command and reads its reply; c.mu must be held
+func (c *redisClient) roundTrip(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if err := writeRedisCommand(c.conn, args); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.r)
+}
+
+func (c *redisClient) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.disconnect()
+
+	return nil
+}
+
+// writeRedisCommand writes a command as an array of bulk strings
+func writeRedisCommand(w io.Writer, args []string) error {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%v\r\n", len(arg), arg)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads a reply; see redisClient.do for what's returned
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("invalid redis reply line %q", line)
+	}
+
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk string length %q", line)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", line)
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		elems := make([]interface{}, n)
+
+		for i := range elems {
+			if elems[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+
+		return elems, nil
+	}
+
+	return nil, fmt.Errorf("unknown redis reply type %q", kind)
+}
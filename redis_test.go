@@ -0,0 +1,273 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// fakeRedis is an in-process Redis server, with just the commands used by the
+// redis lock backend; the scripts it runs with EVAL are the lock's scripts
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu     sync.Mutex
+	data   map[string]string
+	expiry map[string]time.Time
+}
+
+func newFakeRedis(c *C, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	f := &fakeRedis{
+		listener: listener,
+		password: password,
+		data:     make(map[string]string),
+		expiry:   make(map[string]time.Time),
+	}
+
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeRedis) addr() string {
+	return f.listener.Addr().String()
+}
+
+func (f *fakeRedis) close() {
+	f.listener.Close()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	authed := len(f.password) == 0
+
+	for {
+		cmd, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+
+		var args []string
+
+		for _, arg := range cmd.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+
+		var reply string
+
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authed = args[1] == f.password
+			reply = "+OK\r\n"
+
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = f.exec(args)
+		}
+
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// get returns the value of the key, and whether it's set; f.mu must be held
+func (f *fakeRedis) get(key string) (string, bool) {
+	if exp, ok := f.expiry[key]; ok && !time.Now().Before(exp) {
+		delete(f.data, key)
+		delete(f.expiry, key)
+	}
+
+	value, ok := f.data[key]
+	return value, ok
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bulk := func(s string) string { return fmt.Sprintf("$%d\r\n%v\r\n", len(s), s) }
+
+	switch strings.ToUpper(args[0]) {
+	case "SET":
+		if _, ok := f.get(args[1]); ok && len(args) > 3 && args[3] == "NX" {
+			return "$-1\r\n"
+		}
+
+		f.data[args[1]] = args[2]
+		delete(f.expiry, args[1])
+
+		if len(args) > 5 && args[4] == "PX" {
+			ms, _ := strconv.Atoi(args[5])
+			f.expiry[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+
+		return "+OK\r\n"
+	case "GET":
+		if value, ok := f.get(args[1]); ok {
+			return bulk(value)
+		}
+
+		return "$-1\r\n"
+	case "DEL":
+		if _, ok := f.get(args[1]); ok {
+			delete(f.data, args[1])
+			delete(f.expiry, args[1])
+			return ":1\r\n"
+		}
+
+		return ":0\r\n"
+	case "INCR":
+		value, _ := f.get(args[1])
+		n, _ := strconv.Atoi(value)
+		f.data[args[1]] = strconv.Itoa(n + 1)
+		return fmt.Sprintf(":%d\r\n", n+1)
+	case "EVAL":
+		key, value := args[3], args[4]
+
+		if current, ok := f.get(key); !ok || current != value {
+			return ":0\r\n"
+		}
+
+		switch args[1] {
+		case redisUnlockScript:
+			delete(f.data, key)
+			delete(f.expiry, key)
+		case redisRenewScript:
+			ms, _ := strconv.Atoi(args[5])
+			f.expiry[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		default:
+			return "-ERR unknown script\r\n"
+		}
+
+		return ":1\r\n"
+	}
+
+	return fmt.Sprintf("-ERR unknown command '%v'\r\n", args[0])
+}
+
+// value returns the value of the key, and whether it's set
+func (f *fakeRedis) value(key string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.get(key)
+}
+
+func (f *fakeRedis) del(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.data, key)
+	delete(f.expiry, key)
+}
+
+func (*TestSuite) Test_redisProtocol(c *C) {
+	var buf bytes.Buffer
+
+	c.Assert(writeRedisCommand(&buf, []string{"SET", "key", "a b"}), IsNil)
+	c.Check(buf.String(), Equals, "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$3\r\na b\r\n")
+
+	r := bufio.NewReader(strings.NewReader("+OK\r\n-ERR oops\r\n:42\r\n$5\r\nhe\r\nl\r\n$-1\r\n*2\r\n$1\r\na\r\n:1\r\n!bad\r\n"))
+
+	reply, err := readRedisReply(r)
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, "OK")
+
+	_, err = readRedisReply(r)
+	c.Check(err, Equals, redisError("ERR oops"))
+
+	reply, err = readRedisReply(r)
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, int64(42))
+
+	reply, err = readRedisReply(r)
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, "he\r\nl")
+
+	reply, err = readRedisReply(r)
+	c.Assert(err, IsNil)
+	c.Check(reply, IsNil)
+
+	reply, err = readRedisReply(r)
+	c.Assert(err, IsNil)
+	c.Check(reply, DeepEquals, []interface{}{"a", int64(1)})
+
+	_, err = readRedisReply(r)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, `unknown redis reply type '!'`)
+}
+
+func (*TestSuite) Test_redisClient(c *C) {
+	server := newFakeRedis(c, "hunter2")
+	defer server.close()
+
+	_, err := newRedisClient(server.addr(), "wrong", time.Second)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, fmt.Sprintf("failed to authenticate to redis at '%v': WRONGPASS invalid password", server.addr()))
+
+	client, err := newRedisClient(server.addr(), "hunter2", time.Second)
+	c.Assert(err, IsNil)
+
+	reply, err := client.do("SET", "key", "value")
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, "OK")
+
+	reply, err = client.do("GET", "key")
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, "value")
+
+	// an error reply keeps the connection
+	_, err = client.do("FLUSHALL")
+	c.Check(err, Equals, redisError("ERR unknown command 'FLUSHALL'"))
+
+	reply, err = client.do("INCR", "counter")
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, int64(1))
+
+	// reconnecting after the connection is lost
+	client.mu.Lock()
+	client.conn.Close()
+	client.mu.Unlock()
+
+	_, err = client.do("GET", "key")
+	c.Check(err, Not(IsNil))
+
+	reply, err = client.do("GET", "key")
+	c.Assert(err, IsNil)
+	c.Check(reply, Equals, "value")
+
+	c.Check(client.close(), IsNil)
+}
@@ -0,0 +1,172 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// The redis lock backend sets a key to who is holding the lock, only if it's
+// not already set, with the --lock-ttl as its expiry. While the job runs the
+// expiry is pushed back every third of the TTL, so that the lock is held for
+// as long as the job runs but is released on its own if the host goes away.
+//
+// The lock is only released or renewed by its holder, which is checked in a
+// script so that it's atomic. Every time the lock is obtained a counter is
+// incremented, and its value is passed to the command as a fencing token.
+
+const (
+	redisUnlockScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRenewScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// redisTimeout is how long to wait for the Redis server to respond
+const redisTimeout = time.Second * 5
+
+// redisLock is the redis lock backend, which keeps runs of the job on any host
+// using the same Redis server from running at the same time
+type redisLock struct {
+	client *redisClient
+	key    string
+	ttl    time.Duration
+	holder *lockHolder
+	hndlr  *cmdHandler
+
+	// value is what the key was set to when the lock was obtained
+	value string
+	token int64
+
+	// stop tells the goroutine renewing the lock to stop, and it closes
+	// done once it has
+	stop, done chan struct{}
+}
+
+// newRedisLock connects to the --redis-addr server, and returns the lock for
+// the job on it
+func newRedisLock(hndlr *cmdHandler) (*redisLock, error) {
+	client, err := newRedisClient(hndlr.opts.RedisAddr, hndlr.opts.RedisPassword, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redisLock{
+		client: client,
+		key:    fmt.Sprintf("%v:lock:%v", hndlr.opts.Namespace, hndlr.opts.Label),
+		ttl:    time.Second * time.Duration(hndlr.opts.LockTTL),
+		holder: newLockHolder(hndlr),
+		hndlr:  hndlr,
+	}, nil
+}
+
+func (l *redisLock) String() string {
+	return fmt.Sprintf("redis://%v/%v", l.client.addr, l.key)
+}
+
+// ttlMillis returns the TTL of the lock in milliseconds, for PX and PEXPIRE
+func (l *redisLock) ttlMillis() string {
+	return strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+}
+
+func (l *redisLock) tryLock() (bool, error) {
+	l.holder.Start = time.Now()
+
+	value, err := json.Marshal(l.holder)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode lock holder: %v", err)
+	}
+
+	reply, err := l.client.do("SET", l.key, string(value), "NX", "PX", l.ttlMillis())
+	if err != nil {
+		return false, err
+	}
+
+	// the key is already set
+	if reply == nil {
+		return false, nil
+	}
+
+	l.value = string(value)
+
+	reply, err = l.client.do("INCR", l.key+":fencing")
+
+	token, ok := reply.(int64)
+	if err == nil && !ok {
+		err = fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	if err != nil {
+		l.client.do("EVAL", redisUnlockScript, "1", l.key, l.value)
+		return false, fmt.Errorf("failed to get a fencing token: %v", err)
+	}
+
+	l.token = token
+	l.stop, l.done = make(chan struct{}), make(chan struct{})
+
+	go renewLock(l, l.hndlr, l.ttl, l.renew, l.stop, l.done)
+
+	return true, nil
+}
+
+func (l *redisLock) waitLock(deadline time.Time, fifo bool) (bool, error) {
+	return pollLock(l, deadline)
+}
+
+// renew pushes back the expiry of the lock, if it's still held
+func (l *redisLock) renew() (bool, error) {
+	reply, err := l.client.do("EVAL", redisRenewScript, "1", l.key, l.value, l.ttlMillis())
+	if err != nil {
+		return false, err
+	}
+
+	n, _ := reply.(int64)
+	return n == 1, nil
+}
+
+func (l *redisLock) unlock() error {
+	defer l.client.close()
+
+	if l.stop == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	l.stop, l.done = nil, nil
+
+	_, err := l.client.do("EVAL", redisUnlockScript, "1", l.key, l.value)
+	return err
+}
+
+func (l *redisLock) holderDetail() string {
+	reply, err := l.client.do("GET", l.key)
+	if err != nil {
+		return ""
+	}
+
+	value, ok := reply.(string)
+	if !ok {
+		return ""
+	}
+
+	h := &lockHolder{}
+
+	if json.Unmarshal([]byte(value), h) != nil {
+		return ""
+	}
+
+	return fmt.Sprintf(" (%v)", h)
+}
+
+func (l *redisLock) fencingToken() (int64, bool) {
+	return l.token, true
+}
+
+func (l *redisLock) kind() string {
+	return "redis lock"
+}
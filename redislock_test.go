@@ -0,0 +1,148 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_redisLock(c *C) {
+	server := newFakeRedis(c, "")
+	defer server.close()
+
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			Namespace:   "cronner",
+			LockBackend: lockBackendRedis,
+			LockTTL:     1,
+			RedisAddr:   server.addr(),
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	lock, err := newRedisLock(h)
+	c.Assert(err, IsNil)
+	c.Check(lock.String(), Equals, fmt.Sprintf("redis://%v/cronner:lock:testCmd", server.addr()))
+
+	locked, err := lock.tryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	token, ok := lock.fencingToken()
+	c.Check(ok, Equals, true)
+	c.Check(token, Equals, int64(1))
+
+	// someone else can't get it, and can see who has it
+	other, err := newRedisLock(h)
+	c.Assert(err, IsNil)
+
+	locked, err = other.tryLock()
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, false)
+	c.Check(strings.HasPrefix(other.holderDetail(), fmt.Sprintf(" (pid %d on brainbox01, uuid %v, held for ", lock.holder.PID, testCronnerUUID)), Equals, true)
+
+	// the lock is renewed for as long as it's held, past its TTL
+	time.Sleep(time.Millisecond * 1500)
+
+	_, ok = server.value("cronner:lock:testCmd")
+	c.Check(ok, Equals, true)
+
+	// waiting for it to be released
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		lock.unlock()
+	}()
+
+	locked, err = other.waitLock(time.Now().Add(time.Second*5), false)
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, true)
+
+	token, _ = other.fencingToken()
+	c.Check(token, Equals, int64(2))
+
+	// losing the lock, because it expired or was removed by hand
+	server.del("cronner:lock:testCmd")
+	time.Sleep(time.Millisecond * 500)
+
+	emissions := r.recorded()
+	c.Assert(emissions, HasLen, 1)
+	c.Check(emissions[0], DeepEquals, emission{kind: "count", name: "testCmd.lock_lost", value: 1, tags: []string{}})
+
+	// unlocking a lost lock doesn't remove the lock of whoever has it now
+	server.exec([]string{"SET", "cronner:lock:testCmd", "someone else"})
+	c.Check(other.unlock(), IsNil)
+
+	value, _ := server.value("cronner:lock:testCmd")
+	c.Check(value, Equals, "someone else")
+
+	// not being able to connect
+	server.close()
+
+	_, err = newRedisLock(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(strings.HasPrefix(err.Error(), fmt.Sprintf("failed to connect to redis at '%v'", server.addr())), Equals, true)
+}
+
+func (*TestSuite) Test_handleCommand_redisLock(c *C) {
+	server := newFakeRedis(c, "")
+	defer server.close()
+
+	h := &cmdHandler{
+		emitter:  &recordingEmitter{},
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			Namespace:   "cronner",
+			Lock:        true,
+			LockBackend: lockBackendRedis,
+			LockTTL:     30,
+			RedisAddr:   server.addr(),
+			FailEvent:   true,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "echo $CRONNER_FENCING_TOKEN"),
+	}
+
+	// the fencing token is passed to the command, and the lock is released
+	// when it's done
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(out), Equals, "1\n")
+
+	_, ok := server.value("cronner:lock:testCmd")
+	c.Check(ok, Equals, false)
+
+	// the lock being held by another host
+	server.exec([]string{"SET", "cronner:lock:testCmd", `{"pid":1234,"uuid":"other-uuid","hostname":"brainbox02","command":"/bin/sleep 60"}`})
+
+	h.cmd = exec.Command("/bin/true")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 200)
+	c.Check(isLockBusy(err), Equals, true)
+	c.Check(strings.HasPrefix(err.Error(), fmt.Sprintf("failed to obtain lock on 'redis://%v/cronner:lock:testCmd': locked by another process (pid 1234 on brainbox02, uuid other-uuid, held for ", server.addr())), Equals, true)
+
+	// timing out waiting for it
+	h.opts.WaitSeconds = 1
+	h.cmd = exec.Command("/bin/true")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 200)
+	c.Check(strings.HasPrefix(err.Error(), "timeout exceeded (1s) waiting for the redis lock (pid 1234"), Equals, true)
+}
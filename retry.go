@@ -0,0 +1,83 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"os/exec"
+	"time"
+)
+
+const (
+	retryBackoffFixed       = "fixed"
+	retryBackoffExponential = "exponential"
+)
+
+// maxRetryShift caps how many times the exponential backoff doubles the delay,
+// so that a large --retries value can't overflow the time.Duration
+const maxRetryShift = 16
+
+// retryRand is the source of the jitter added to exponential backoff
+var retryRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// shouldRetry returns whether the attempt that exited with return code ret
+// should be retried, based on how many attempts have already been made
+func shouldRetry(opts *binArgs, attempt, ret int) bool {
+	if uint64(attempt) > opts.Retries {
+		return false
+	}
+
+	if len(opts.RetryCodes) == 0 {
+		return true
+	}
+
+	for _, code := range opts.RetryCodes {
+		if code == ret {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retryDelay returns how long to wait after the failed attempt before making
+// the next one
+//
+// the fixed backoff always waits --retry-delay seconds, the exponential one
+// doubles it after each attempt and then picks a random delay between half of
+// that value and the full value to avoid retrying in lock step
+func retryDelay(opts *binArgs, attempt int) time.Duration {
+	delay := time.Second * time.Duration(opts.RetryDelay)
+
+	if opts.RetryBackoff != retryBackoffExponential || delay == 0 {
+		return delay
+	}
+
+	shift := uint(attempt - 1)
+	if shift > maxRetryShift {
+		shift = maxRetryShift
+	}
+
+	delay <<= shift
+	half := delay / 2
+
+	return half + time.Duration(retryRand.Int63n(int64(half)+1))
+}
+
+// copyCmd builds a new, unstarted, *exec.Cmd from one that has already been
+// run, as an *exec.Cmd can't be started more than once
+func copyCmd(cmd *exec.Cmd) *exec.Cmd {
+	return &exec.Cmd{
+		Path:        cmd.Path,
+		Args:        cmd.Args,
+		Env:         cmd.Env,
+		Dir:         cmd.Dir,
+		Stdin:       cmd.Stdin,
+		Stdout:      cmd.Stdout,
+		Stderr:      cmd.Stderr,
+		ExtraFiles:  cmd.ExtraFiles,
+		SysProcAttr: cmd.SysProcAttr,
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_shouldRetry(c *C) {
+	opts := &binArgs{Retries: 2}
+
+	c.Check(shouldRetry(opts, 1, 1), Equals, true)
+	c.Check(shouldRetry(opts, 2, 1), Equals, true)
+	c.Check(shouldRetry(opts, 3, 1), Equals, false)
+
+	opts.RetryCodes = []int{75, 124}
+
+	c.Check(shouldRetry(opts, 1, 1), Equals, false)
+	c.Check(shouldRetry(opts, 1, 75), Equals, true)
+	c.Check(shouldRetry(opts, 2, 124), Equals, true)
+	c.Check(shouldRetry(opts, 3, 124), Equals, false)
+
+	opts = &binArgs{}
+	c.Check(shouldRetry(opts, 1, 1), Equals, false)
+}
+
+func (*TestSuite) Test_retryDelay(c *C) {
+	opts := &binArgs{RetryBackoff: retryBackoffFixed, RetryDelay: 3}
+
+	c.Check(retryDelay(opts, 1), Equals, time.Second*3)
+	c.Check(retryDelay(opts, 5), Equals, time.Second*3)
+
+	opts.RetryBackoff = retryBackoffExponential
+
+	for attempt := 1; attempt <= 4; attempt++ {
+		max := time.Second * 3 << uint(attempt-1)
+
+		delay := retryDelay(opts, attempt)
+		c.Check(delay >= max/2, Equals, true)
+		c.Check(delay <= max, Equals, true)
+	}
+
+	// the exponent is capped
+	c.Check(retryDelay(opts, 1000) <= time.Second*3<<maxRetryShift, Equals, true)
+
+	opts.RetryDelay = 0
+	c.Check(retryDelay(opts, 3), Equals, time.Duration(0))
+}
+
+func (*TestSuite) Test_copyCmd(c *C) {
+	cmd := exec.Command("/bin/echo", "somevalue")
+	cmd.Dir = "/tmp"
+	cmd.Env = []string{"TEST=1"}
+
+	c.Assert(cmd.Run(), IsNil)
+
+	cp := copyCmd(cmd)
+	c.Check(cp.Path, Equals, cmd.Path)
+	c.Check(cp.Args, DeepEquals, cmd.Args)
+	c.Check(cp.Dir, Equals, "/tmp")
+	c.Check(cp.Env, DeepEquals, []string{"TEST=1"})
+	c.Check(cp.Process, IsNil)
+	c.Check(cp.Run(), IsNil)
+}
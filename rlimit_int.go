@@ -0,0 +1,15 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+//
+// +build freebsd dragonfly
+
+package main
+
+import "syscall"
+
+// newSysRlimit returns a syscall.Rlimit with both limits set to value; the
+// limits are signed here, with unlimited being -1
+func newSysRlimit(value uint64) *syscall.Rlimit {
+	return &syscall.Rlimit{Cur: int64(value), Max: int64(value)}
+}
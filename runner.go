@@ -8,11 +8,12 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
-	"path"
+	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -33,13 +34,46 @@ const intErrCode = 200
 // MaxBody is the maximum length of a event body
 const MaxBody = 4096
 
-// asyncExecCmd is a function to run a command and send
-// the error value back through a channel
-func asyncExecCmd(cmd *exec.Cmd, c chan<- error) {
-	c <- cmd.Run()
+// timeoutErrCode is the return code used when the command was killed for
+// running longer than --timeout; it's the same one timeout(1) uses
+const timeoutErrCode = 124
+
+// asyncWaitCmd is a function to wait for a started command
+// and send the error value back through a channel
+func asyncWaitCmd(cmd *exec.Cmd, c chan<- error) {
+	c <- cmd.Wait()
 	close(c)
 }
 
+// metricTags builds the list of tags to send with statsd metrics
+func metricTags(hndlr *cmdHandler) []string {
+	tags := []string{}
+
+	if len(hndlr.opts.Group) > 0 {
+		tags = append(tags, fmt.Sprintf("cronner_group:%s", hndlr.opts.Group))
+	}
+
+	if hndlr.opts.Parent && len(hndlr.parentMetricTags) > 0 {
+		tags = append(tags, hndlr.parentMetricTags...)
+	}
+
+	if len(hndlr.opts.Tags) > 0 {
+		tags = append(tags, hndlr.opts.Tags...)
+	}
+
+	return tags
+}
+
+// commandLine returns the command and its arguments, for recording who ran
+// what; with --sensitive the arguments are left out, as they may hold secrets
+func commandLine(hndlr *cmdHandler) string {
+	if hndlr.opts.Sensitive && len(hndlr.cmd.Args) > 0 {
+		return hndlr.cmd.Args[0]
+	}
+
+	return strings.Join(hndlr.cmd.Args, " ")
+}
+
 func setEnv(hndlr *cmdHandler) {
 	os.Setenv("CRONNER_PARENT_UUID", hndlr.uuid)
 	os.Setenv("CRONNER_PARENT_EVENT_GROUP", hndlr.opts.EventGroup)
@@ -56,6 +90,9 @@ func unsetEnv() {
 	for _, k := range cronnerMetricEnvVars {
 		os.Unsetenv(k)
 	}
+
+	os.Unsetenv(slotEnvVar)
+	os.Unsetenv(fencingTokenEnvVar)
 }
 
 // handleCommand is a function that handles the entire process of running a command:
@@ -65,211 +102,369 @@ func unsetEnv() {
 // * timing how long it takes and emitting a metric for it
 // * tracking command return codes and emitting a metric for it
 // * emitting warning metrics if a command has exceeded its running time
+// * killing the command if it has exceeded its timeout
+// * retrying the command if it failed
+// * forwarding signals sent to cronner on to the command
 //
 // it returns the following:
 //
 // * (int) return code
-// * (float64) run time
+// * ([]byte) output of the command
+// * (float64) run time in milliseconds, or -1 if it returned before running the command
+// * (error) error encountered while handling the command, if any
 func handleCommand(hndlr *cmdHandler) (int, []byte, float64, error) {
+	invoked := time.Now()
+
 	unsetEnv()
 
 	// set the environment for this invocation of cronner
 	setEnv(hndlr)
 	defer unsetEnv()
 
+	splay := splayDelay(hndlr)
+
 	if hndlr.opts.AllEvents {
+		body := fmt.Sprintf("UUID: %v\n", hndlr.uuid)
+
+		if len(hndlr.opts.Splay) > 0 {
+			body += fmt.Sprintf("splay: %v\n", splay.Round(time.Millisecond))
+		}
+
 		// emit a DD event to indicate we are starting the job
-		emitEvent(fmt.Sprintf("Cron %v starting on %v", hndlr.opts.Label, hndlr.hostname), fmt.Sprintf("UUID: %v\n", hndlr.uuid), hndlr.opts.Label, "info", hndlr)
+		emitEvent(fmt.Sprintf("Cron %v starting on %v", hndlr.opts.Label, hndlr.hostname), body, hndlr.opts.Label, "info", hndlr)
 	}
 
-	// set up the output buffers for the command
-	var b bytes.Buffer
+	// set up where the output of the command goes
+	//
+	// if a head or tail size was given, only that much of the output is kept
+	// in memory; otherwise all of it is
+	output := newCommandOutput(hndlr.opts)
+
+	// look up who to run the command as before grabbing the lock, so that a
+	// user that doesn't exist doesn't hold up other runs of the job
+	cred, credErr := resolveCredential(hndlr.opts)
+	if credErr != nil {
+		emitServiceCheck(hndlr, serviceCheckCritical, credErr.Error())
+		recordNotRun(hndlr, invoked, intErrCode, historyOutcomeNotRun, credErr)
+		return intErrCode, nil, -1, credErr
+	}
 
-	// setup multiple streams only on passthru
-	// combine stdout and stderr to the same buffer
-	// if we actually plan on using the command output
-	// otherwise, /dev/null
-	if hndlr.opts.AllEvents || hndlr.opts.FailEvent || hndlr.opts.LogFail {
-		if hndlr.opts.Passthru {
-			hndlr.cmd.Stdout = io.MultiWriter(os.Stdout, &b)
-			hndlr.cmd.Stderr = io.MultiWriter(os.Stderr, &b)
-		} else {
-			hndlr.cmd.Stdout = &b
-			hndlr.cmd.Stderr = &b
-		}
-	} else {
-		if hndlr.opts.Passthru {
-			hndlr.cmd.Stdout = os.Stdout
-			hndlr.cmd.Stderr = os.Stderr
-		} else {
-			hndlr.cmd.Stdout = nil
-			hndlr.cmd.Stderr = nil
+	if cred != nil {
+		if hndlr.cmd.SysProcAttr == nil {
+			hndlr.cmd.SysProcAttr = &syscall.SysProcAttr{}
 		}
+		hndlr.cmd.SysProcAttr.Credential = cred
 	}
 
-	// build a new lockFile
-	lockFile := flock.NewFlock(path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.lock", hndlr.opts.Label)))
-
-	var err error
+	// wait out the splay before grabbing the lock, so that it doesn't hold
+	// up other runs of the job; it's not part of the command's run time
+	if len(hndlr.opts.Splay) > 0 {
+		hndlr.emitter.Timing(fmt.Sprintf("%v.splay", hndlr.opts.Label), float64(splay)/float64(time.Millisecond), metricTags(hndlr))
+		time.Sleep(splay)
+	}
 
 	// grab the lock
+	var lock jobLock
+
 	if hndlr.opts.Lock {
-		locked, err := lockFile.TryLock()
+		var err error
+
+		if lock, err = newJobLock(hndlr); err == nil {
+			err = acquireLock(hndlr, lock)
+		}
 
 		if err != nil {
-			retErr := fmt.Errorf("failed to obtain lock on '%v': %v", lockFile, err)
-			return intErrCode, nil, -1, retErr
-		}
-
-		if !locked && hndlr.opts.WaitSeconds == 0 {
-			retErr := fmt.Errorf("failed to obtain lock on '%v': locked by another process", lockFile)
-			return intErrCode, nil, -1, retErr
-		} else if !locked && hndlr.opts.WaitSeconds > 0 {
-			tick := time.NewTicker(time.Second * time.Duration(hndlr.opts.WaitSeconds))
-
-		GotLock:
-			for {
-				select {
-				case _ = <-tick.C:
-					retErr := fmt.Errorf("timeout exceeded (%ds) waiting for the file lock", hndlr.opts.WaitSeconds)
-					return intErrCode, nil, -1, retErr
-				default:
-					locked, err = lockFile.TryLock()
-
-					if !locked || err != nil {
-						time.Sleep(time.Second * 1)
-						continue
-					}
-
-					break GotLock
-				}
+			if isLockBusy(err) && hndlr.opts.OnLocked == onLockedSkip {
+				skipRun(hndlr, err)
+				recordNotRun(hndlr, invoked, 0, historyOutcomeSkipped, err)
+				return 0, nil, -1, nil
 			}
+
+			emitServiceCheck(hndlr, serviceCheckCritical, err.Error())
+			recordNotRun(hndlr, invoked, intErrCode, historyOutcomeNotRun, err)
+			return intErrCode, nil, -1, err
+		}
+
+		if token, ok := lock.fencingToken(); ok {
+			os.Setenv(fencingTokenEnvVar, strconv.FormatInt(token, 10))
 		}
 	}
 
+	// grab one of the slots, if limited concurrency was asked for instead
+	var slotLock *flock.Flock
+
+	if hndlr.opts.MaxConcurrent > 0 {
+		waitStart := time.Now()
+
+		var slot, inUse int
+		var slotErr error
+
+		if slotLock, slot, inUse, slotErr = acquireSlot(hndlr); slotErr != nil {
+			if lock != nil {
+				lock.unlock()
+			}
+
+			if isLockBusy(slotErr) && hndlr.opts.OnLocked == onLockedSkip {
+				skipRun(hndlr, slotErr)
+				recordNotRun(hndlr, invoked, 0, historyOutcomeSkipped, slotErr)
+				return 0, nil, -1, nil
+			}
+
+			emitServiceCheck(hndlr, serviceCheckCritical, slotErr.Error())
+			recordNotRun(hndlr, invoked, intErrCode, historyOutcomeNotRun, slotErr)
+			return intErrCode, nil, -1, slotErr
+		}
+
+		slotTags := metricTags(hndlr)
+		waitMs := float64(time.Since(waitStart)) / float64(time.Millisecond)
+
+		hndlr.emitter.Timing(fmt.Sprintf("%v.slot_wait", hndlr.opts.Label), waitMs, slotTags)
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.slots_in_use", hndlr.opts.Label), float64(inUse), slotTags)
+
+		if err := writeLockHolder(slotLock.Path(), newLockHolder(hndlr)); err != nil {
+			logger.Errorf("%v", err)
+		}
+
+		os.Setenv(slotEnvVar, strconv.Itoa(slot))
+	}
+
+	// stream the output to disk for --log-fail if it can't all be kept in
+	// memory, or if it's being split by stream
+	output.openLogs(hndlr)
+	defer output.close()
+
+	output.attach(hndlr.cmd)
+
+	// put the command in its own process group so that a timeout can signal
+	// everything the command may have spawned, and so that a signal sent to
+	// our process group, like a ^C from the terminal, only reaches it once
+	// when it's forwarded
+	if hndlr.cmd.SysProcAttr == nil {
+		hndlr.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	hndlr.cmd.SysProcAttr.Setpgid = true
+
+	// trap the signals that would normally kill cronner, so that they can be
+	// forwarded to the command instead of orphaning it
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, forwardedSignals...)
+	defer signal.Stop(sigChan)
+
 	var startTime, stopTime time.Time
+	var res runResult
+	var usage resourceUsage
+	var ret, attempt int
+	var err error
 
-	// if we have a timer value, do all the extra logic to
-	// use the ticker to send out warning events
+	// run the command, and retry it if it failed and retries were asked for
 	//
-	// otherwise, KISS
-	if hndlr.opts.WarnAfter > 0 {
-		ch := make(chan error)
-
-		// use time.Tick() instead of time.NewTicker() because
-		// we don't ever need to run Stop() on this ticker as cronner
-		// won't live much beyond the command returning
-		tickChan := time.Tick(time.Second * time.Duration(hndlr.opts.WarnAfter))
-
-		// get the value for now with an embedded monotonic time source
-		startTime = time.Now()
-
-		go asyncExecCmd(hndlr.cmd, ch)
-
-		// this is an open loop to wait for either the command to return
-		// or time to be sent over the ticker channel
-		//
-		// the WaitLoop label is used to break from the select statement
-	WaitLoop:
-		for {
-			// wait for either the command channel to return an error value
-			// or wait for the ticker channel to return a time.Time value
-			select {
-			case m := <-ch:
-				// the comand returned; get an end time,
-				// set the error vailue, and bail out of here!
-				stopTime = time.Now()
-				err = m
-
-				break WaitLoop
-			case _, ok := <-tickChan:
-				if ok {
-					runSecs := time.Now().Sub(startTime) / time.Second
-					title := fmt.Sprintf("Cron %v still running after %d seconds on %v", hndlr.opts.Label, int64(runSecs), hndlr.hostname)
-					body := fmt.Sprintf("UUID: %v\nrunning for %v seconds", hndlr.uuid, int64(runSecs))
-					emitEvent(title, body, hndlr.opts.Label, "warning", hndlr)
-				}
-			}
+	// this is being done within the lock so that another invocation can't
+	// sneak in between attempts
+RetryLoop:
+	for attempt = 1; ; attempt++ {
+		if attempt > 1 {
+			// only keep the output of the most recent attempt
+			output.reset()
+			hndlr.cmd = copyCmd(hndlr.cmd)
+		}
+
+		res = runCommand(hndlr, sigChan)
+
+		if attempt == 1 {
+			startTime = res.start
+		}
+		stopTime = res.stop
+		usage.add(hndlr.cmd.ProcessState)
+
+		ret, err = commandResult(hndlr, res)
+
+		if hndlr.opts.Retries > 0 {
+			attemptTags := append(metricTags(hndlr), fmt.Sprintf("cronner_attempt:%d", attempt))
+			attemptRtMs := float64(res.stop.Sub(res.start)) / float64(time.Millisecond)
+
+			hndlr.emitter.Timing(fmt.Sprintf("%v.attempt.time", hndlr.opts.Label), attemptRtMs, attemptTags)
+			hndlr.emitter.Gauge(fmt.Sprintf("%v.attempt.exit_code", hndlr.opts.Label), float64(ret), attemptTags)
 		}
-	} else {
-		// get the value for now with an embedded monotonic time source
-		startTime = time.Now()
 
-		err = hndlr.cmd.Run()
+		if err == nil || res.signal != nil || !shouldRetry(hndlr.opts, attempt, ret) {
+			break
+		}
 
-		// get an end time
-		stopTime = time.Now()
+		delay := retryDelay(hndlr.opts, attempt)
+
+		logger.Infof("attempt %d of %v failed (exit code %d), retrying in %v", attempt, hndlr.opts.Label, ret, delay)
+
+		// don't start another attempt if we were asked to stop while waiting
+		select {
+		case <-time.After(delay):
+		case sig := <-sigChan:
+			res.signal = sig
+			ret, err = commandResult(hndlr, res)
+			break RetryLoop
+		}
 	}
 
 	monotonicRtMs := float64(stopTime.Sub(startTime)) / float64(time.Millisecond)
 
-	// calculate the return code of the command
-	// default to return code 0: success
-	//
-	// this is being done within the lock because
-	// even if we fail to remove the lockfile, we still
-	// need to know what the command did.
-	var ret int
-	if err != nil {
-		if ee, ok := err.(*exec.ExitError); ok {
-			status := ee.Sys().(syscall.WaitStatus)
-			ret = status.ExitStatus()
-		} else {
-			ret = intErrCode
+	// whether the kernel killed the command for reaching a resource limit
+	var limitMsg string
+
+	if err != nil && !res.timedOut && res.signal == nil {
+		limitMsg = limitKill(hndlr.opts, hndlr.cmd.ProcessState)
+	}
+
+	// read what everything in the command's cgroup used, before removing it
+	var cgStats *cgroupStats
+
+	if hndlr.cgroup != nil {
+		cgStats = hndlr.cgroup.stats()
+
+		if cgErr := hndlr.cgroup.remove(); cgErr != nil {
+			logger.Errorf("%v", cgErr)
+		}
+
+		hndlr.cgroup = nil
+	}
+
+	// load and update what we know about the previous runs, if any of the
+	// options that need it were given; aborted runs don't count either way.
+	// This is done while the lock is still held, so that overlapping runs
+	// don't lose each other's updates.
+	var state *runState
+	var prevFailures uint64
+
+	if trackState(hndlr.opts) {
+		var stateErr error
+		stateFile := stateFilename(hndlr)
+
+		if state, stateErr = readState(stateFile); stateErr != nil {
+			logger.Errorf("%v", stateErr)
+		}
+
+		prevFailures = state.ConsecutiveFailures
+
+		if res.signal == nil {
+			state.update(hndlr.uuid, ret, stopTime)
+
+			if stateErr = state.write(stateFile); stateErr != nil {
+				logger.Errorf("%v", stateErr)
+			}
 		}
 	}
 
 	// unlock
-	if hndlr.opts.Lock {
-		if lockErr := lockFile.Unlock(); lockErr != nil {
+	if lock != nil {
+		if lockErr := lock.unlock(); lockErr != nil {
 			// if the command didn't fail, but unlocking did
 			// replace the command error with the unlock error
 			// otherwise just print the error
-			retErr := fmt.Errorf("failed to unlock: '%v': %v", lockFile, lockErr)
+			retErr := fmt.Errorf("failed to unlock: '%v': %v", lock, lockErr)
 			if err == nil {
 				err = retErr
 			} else {
-				logger.Errorf(retErr.Error())
+				logger.Errorf("%v", retErr)
+			}
+		}
+	}
+
+	if slotLock != nil {
+		if holderErr := removeLockHolder(slotLock.Path()); holderErr != nil {
+			logger.Errorf("%v", holderErr)
+		}
+
+		if lockErr := slotLock.Unlock(); lockErr != nil {
+			retErr := fmt.Errorf("failed to unlock: '%v': %v", slotLock, lockErr)
+			if err == nil {
+				err = retErr
+			} else {
+				logger.Errorf("%v", retErr)
 			}
 		}
 	}
 
 	// emit the metric for how long it took us and return code
-	tags := []string{}
+	tags := metricTags(hndlr)
 
-	if len(hndlr.opts.Group) > 0 {
-		tags = append(tags, fmt.Sprintf("cronner_group:%s", hndlr.opts.Group))
+	hndlr.emitter.Timing(fmt.Sprintf("%v.time", hndlr.opts.Label), monotonicRtMs, tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.exit_code", hndlr.opts.Label), float64(ret), tags)
+
+	if hndlr.opts.Retries > 0 {
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.attempts", hndlr.opts.Label), float64(attempt), tags)
 	}
 
-	if hndlr.opts.Parent && len(hndlr.parentMetricTags) > 0 {
-		tags = append(tags, hndlr.parentMetricTags...)
+	if hndlr.opts.Rusage {
+		usage.emit(hndlr, tags)
 	}
 
-	if len(hndlr.opts.Tags) > 0 {
-		tags = append(tags, hndlr.opts.Tags...)
+	if cgStats != nil {
+		cgStats.emit(hndlr, tags)
 	}
 
-	hndlr.gs.Timing(fmt.Sprintf("%v.time", hndlr.opts.Label), monotonicRtMs, tags)
-	hndlr.gs.Gauge(fmt.Sprintf("%v.exit_code", hndlr.opts.Label), float64(ret), tags)
+	if size, ok := output.size(); ok {
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.output_bytes", hndlr.opts.Label), float64(size), tags)
+	}
 
-	out := b.Bytes()
+	out := output.bytes()
 
 	// default variables are for success
 	// we change them later if there was a failure
 	msg := "succeeded"
 	alertType := "success"
+	status := serviceCheckOK
 
 	// if the command failed change the state variables to their failure values
 	if err != nil {
 		msg = "failed"
 		alertType = "error"
+		status = serviceCheckCritical
+
+		if res.timedOut {
+			msg = "timed out"
+		} else if res.signal != nil {
+			// an interrupted run doesn't tell us whether the job works
+			msg = fmt.Sprintf("aborted by %v", signalName(res.signal))
+			status = serviceCheckUnknown
+		} else if cgStats != nil && cgStats.oomKills > 0 {
+			msg = "failed (out of memory)"
+		}
 	}
 
-	if hndlr.opts.AllEvents || (hndlr.opts.FailEvent && alertType == "error") {
-		// build the pieces of the completion event
-		title := fmt.Sprintf("Cron %v %v in %.5f seconds on %v", hndlr.opts.Label, msg, monotonicRtMs/1000, hndlr.hostname)
+	if state != nil {
+		hndlr.emitter.Gauge(fmt.Sprintf("%v.consecutive_failures", hndlr.opts.Label), float64(state.ConsecutiveFailures), tags)
+	}
+
+	title := fmt.Sprintf("Cron %v %v in %.5f seconds on %v", hndlr.opts.Label, msg, monotonicRtMs/1000, hndlr.hostname)
+
+	emitServiceCheck(hndlr, status, title)
+
+	// with --alert-after-failures the failure event is held back until the
+	// job has failed enough times in a row
+	failEvent := hndlr.opts.FailEvent && alertType == "error"
 
+	if failEvent && state != nil {
+		failEvent = state.ConsecutiveFailures >= alertThreshold(hndlr.opts)
+	}
+
+	// aborted runs always get an event, as otherwise there would be nothing
+	// to tell that the job was interrupted
+	if hndlr.opts.AllEvents || failEvent || res.signal != nil {
+		// build the pieces of the completion event
 		body := fmt.Sprintf("UUID: %v\nexit code: %d\n", hndlr.uuid, ret)
+		if attempt > 1 {
+			body = fmt.Sprintf("%vattempts: %d\n", body, attempt)
+		}
+		if cgStats != nil && cgStats.oomKills > 0 {
+			body = fmt.Sprintf("%vout of memory: the OOM killer killed %d processes in the command's cgroup\n", body, cgStats.oomKills)
+		}
+		if len(limitMsg) > 0 {
+			body = fmt.Sprintf("%vresource limit: %v\n", body, limitMsg)
+		}
+		if state != nil && state.ConsecutiveFailures > 0 {
+			body = fmt.Sprintf("%vconsecutive failures: %d\n", body, state.ConsecutiveFailures)
+		}
+		if hndlr.opts.Rusage {
+			body = fmt.Sprintf("%v%v", body, usage.String())
+		}
 		if err != nil {
 			er := regexp.MustCompile("^exit status ([-]?\\d)")
 
@@ -280,17 +475,66 @@ func handleCommand(hndlr *cmdHandler) (int, []byte, float64, error) {
 			}
 		}
 
-		var cmdOutput string
+		body = fmt.Sprintf("%v%v", body, output.eventBody())
+
+		emitEvent(title, body, hndlr.opts.Label, alertType, hndlr)
 
-		if len(out) > 0 {
-			cmdOutput = string(out)
-		} else {
-			cmdOutput = "(none)"
+		sendNotifications(hndlr, &notification{
+			Title:     title,
+			Label:     hndlr.opts.Label,
+			Group:     hndlr.opts.EventGroup,
+			Hostname:  hndlr.hostname,
+			UUID:      hndlr.uuid,
+			AlertType: alertType,
+			ExitCode:  ret,
+			Duration:  monotonicRtMs / 1000,
+			Attempts:  attempt,
+			Output:    tailOutput(out, MaxBody),
+			Tags:      hndlr.opts.Tags,
+		})
+	}
+
+	// let people know the job is working again, but only if they were told
+	// it was failing in the first place
+	if hndlr.opts.EventRecovery && alertType == "success" && prevFailures >= alertThreshold(hndlr.opts) {
+		recoveryTitle := fmt.Sprintf("Cron %v recovered after %d failures on %v", hndlr.opts.Label, prevFailures, hndlr.hostname)
+
+		emitEvent(recoveryTitle, fmt.Sprintf("UUID: %v\nexit code: %d\n", hndlr.uuid, ret), hndlr.opts.Label, "success", hndlr)
+
+		sendNotifications(hndlr, &notification{
+			Title:     recoveryTitle,
+			Label:     hndlr.opts.Label,
+			Group:     hndlr.opts.EventGroup,
+			Hostname:  hndlr.hostname,
+			UUID:      hndlr.uuid,
+			AlertType: "success",
+			ExitCode:  ret,
+			Duration:  monotonicRtMs / 1000,
+			Attempts:  attempt,
+			Tags:      hndlr.opts.Tags,
+		})
+	}
+
+	if len(hndlr.opts.PromTextfileDir) > 0 {
+		if promErr := writePromTextfile(hndlr, ret, startTime, stopTime); promErr != nil {
+			logger.Errorf("%v", promErr)
 		}
+	}
 
-		body = fmt.Sprintf("%voutput: %v", body, cmdOutput)
+	if len(hndlr.opts.HistoryDir) > 0 {
+		rec := newHistoryRecord(hndlr)
+		rec.Start, rec.End = startTime, stopTime
+		rec.Duration = monotonicRtMs / 1000
+		rec.ExitCode = ret
+		rec.Outcome = msg
 
-		emitEvent(title, body, hndlr.opts.Label, alertType, hndlr)
+		if alertType == "error" && hndlr.opts.LogFail {
+			rec.LogFiles = output.logFiles(hndlr)
+		}
+
+		if histErr := recordHistory(hndlr.opts.HistoryDir, hndlr.opts.HistoryRetention, rec); histErr != nil {
+			logger.Errorf("%v", histErr)
+		}
 	}
 
 	// DRY: stdout/stderr has already been printed
@@ -300,16 +544,230 @@ func handleCommand(hndlr *cmdHandler) (int, []byte, float64, error) {
 
 	// this code block is meant to be ran last
 	if alertType == "error" && hndlr.opts.LogFail {
-		filename := path.Join(hndlr.opts.LogPath, fmt.Sprintf("%v-%v.out", hndlr.opts.Label, hndlr.uuid))
-		if !writeOutput(filename, out, hndlr.opts.Sensitive) {
+		if !output.saveLogs(hndlr) {
 			os.Exit(1)
 		}
+
+		for _, filename := range output.logFiles(hndlr) {
+			if chownErr := chownToCommand(hndlr, filename); chownErr != nil {
+				logger.Errorf("%v", chownErr)
+			}
+		}
 	}
 
 	return ret, out, monotonicRtMs, err
 }
 
-// emit a godspeed (dogstatsd) event
+// acquireLock grabs the lock for the command, waiting up to --wait-secs for
+// it if another process is holding it; with --on-locked=queue it waits in the
+// queue for the lock, without a limit unless --wait-secs was given
+func acquireLock(hndlr *cmdHandler, lock jobLock) error {
+	queue := hndlr.opts.OnLocked == onLockedQueue
+
+	if hndlr.opts.WaitSeconds == 0 && !queue {
+		locked, err := lock.tryLock()
+
+		if err != nil {
+			return fmt.Errorf("failed to obtain lock on '%v': %v", lock, err)
+		}
+
+		if !locked {
+			return &lockBusyError{fmt.Sprintf("failed to obtain lock on '%v': locked by another process%v", lock, lock.holderDetail())}
+		}
+
+		return nil
+	}
+
+	waitStart := time.Now()
+
+	var deadline time.Time
+
+	if hndlr.opts.WaitSeconds > 0 {
+		deadline = waitStart.Add(time.Second * time.Duration(hndlr.opts.WaitSeconds))
+	}
+
+	locked, err := lock.waitLock(deadline, hndlr.opts.LockFIFO || queue)
+	if err != nil {
+		return fmt.Errorf("failed to obtain lock on '%v': %v", lock, err)
+	}
+
+	tags := metricTags(hndlr)
+
+	if !locked {
+		hndlr.emitter.Count(fmt.Sprintf("%v.lock_timeout", hndlr.opts.Label), 1, tags)
+		return &lockBusyError{fmt.Sprintf("timeout exceeded (%ds) waiting for the %v%v", hndlr.opts.WaitSeconds, lock.kind(), lock.holderDetail())}
+	}
+
+	waitMs := float64(time.Since(waitStart)) / float64(time.Millisecond)
+	hndlr.emitter.Timing(fmt.Sprintf("%v.lock_wait", hndlr.opts.Label), waitMs, tags)
+
+	return nil
+}
+
+// skipRun reports a run that was skipped with --on-locked=skip, because the
+// previous run of the job is still holding the lock
+func skipRun(hndlr *cmdHandler, reason error) {
+	logger.Infof("skipping %v: %v", hndlr.opts.Label, reason)
+
+	hndlr.emitter.Count(fmt.Sprintf("%v.skipped", hndlr.opts.Label), 1, metricTags(hndlr))
+
+	if hndlr.opts.AllEvents {
+		emitEvent(
+			fmt.Sprintf("Cron %v skipped on %v, previous run still active", hndlr.opts.Label, hndlr.hostname),
+			fmt.Sprintf("UUID: %v\n%v\n", hndlr.uuid, reason),
+			hndlr.opts.Label, "info", hndlr,
+		)
+	}
+}
+
+// runResult is the outcome of a single run of the command
+type runResult struct {
+	start, stop time.Time
+
+	// timedOut is whether the command was killed for exceeding --timeout
+	timedOut bool
+
+	// signal is the first signal cronner received and forwarded to the
+	// command, if the command then failed or was killed by it; it's nil if
+	// the run wasn't aborted
+	signal os.Signal
+
+	err error
+}
+
+// commandResult calculates the return code of the command from the result of
+// runCommand, defaulting to return code 0: success
+//
+// if the command timed out or was aborted the error is replaced with one
+// saying so; an aborted command's return code is still how it exited, or
+// 128 + the signal number if a signal killed it
+func commandResult(hndlr *cmdHandler, res runResult) (int, error) {
+	if res.timedOut {
+		return timeoutErrCode, fmt.Errorf("command timed out after %d seconds", hndlr.opts.Timeout)
+	}
+
+	if res.err == nil {
+		return 0, nil
+	}
+
+	ret := intErrCode
+
+	if ee, ok := res.err.(*exec.ExitError); ok {
+		status := ee.Sys().(syscall.WaitStatus)
+		ret = status.ExitStatus()
+
+		if res.signal != nil && status.Signaled() {
+			ret = signalExitCode(status.Signal())
+		}
+	}
+
+	if res.signal != nil {
+		return ret, fmt.Errorf("command aborted by %v", signalName(res.signal))
+	}
+
+	return ret, res.err
+}
+
+// runCommand runs the command and waits for it to finish. While waiting it
+// emits the --warn-after warning events, forwards any signals received on
+// sigChan to the command, and enforces the --timeout by sending SIGTERM to the
+// command's process group followed by a SIGKILL once the grace period has
+// elapsed, or once the command exits if that's sooner.
+func runCommand(hndlr *cmdHandler, sigChan <-chan os.Signal) runResult {
+	var res runResult
+
+	// a nil channel blocks forever, so the select statement below
+	// ignores any timer that hasn't been enabled
+	var tickChan, timeoutChan, killChan <-chan time.Time
+
+	if hndlr.opts.WarnAfter > 0 {
+		ticker := time.NewTicker(time.Second * time.Duration(hndlr.opts.WarnAfter))
+		defer ticker.Stop()
+
+		tickChan = ticker.C
+	}
+
+	if hndlr.opts.Timeout > 0 {
+		timer := time.NewTimer(time.Second * time.Duration(hndlr.opts.Timeout))
+		defer timer.Stop()
+
+		timeoutChan = timer.C
+	}
+
+	// get the value for now with an embedded monotonic time source
+	res.start = time.Now()
+
+	if res.err = startCommand(hndlr); res.err != nil {
+		res.stop = time.Now()
+		return res
+	}
+
+	ch := make(chan error)
+	go asyncWaitCmd(hndlr.cmd, ch)
+
+	// this is an open loop to wait for either the command to return,
+	// time to be sent over one of the timer channels, or a signal
+	//
+	// the WaitLoop label is used to break from the select statement
+WaitLoop:
+	for {
+		select {
+		case m := <-ch:
+			// the comand returned; get an end time,
+			// set the error vailue, and bail out of here!
+			res.stop = time.Now()
+			res.err = m
+
+			// anything the command started that ignored the SIGTERM
+			// would otherwise outlive the run, and the lock
+			if res.timedOut {
+				signalProcessGroup(hndlr.cmd, syscall.SIGKILL)
+			}
+
+			break WaitLoop
+		case <-tickChan:
+			runSecs := time.Now().Sub(res.start) / time.Second
+			title := fmt.Sprintf("Cron %v still running after %d seconds on %v", hndlr.opts.Label, int64(runSecs), hndlr.hostname)
+			body := fmt.Sprintf("UUID: %v\nrunning for %v seconds", hndlr.uuid, int64(runSecs))
+			emitEvent(title, body, hndlr.opts.Label, "warning", hndlr)
+			emitServiceCheck(hndlr, serviceCheckWarning, title)
+		case <-timeoutChan:
+			res.timedOut = true
+
+			hndlr.emitter.Count(fmt.Sprintf("%v.timeout", hndlr.opts.Label), 1, metricTags(hndlr))
+
+			title := fmt.Sprintf("Cron %v timed out after %d seconds on %v", hndlr.opts.Label, hndlr.opts.Timeout, hndlr.hostname)
+			body := fmt.Sprintf("UUID: %v\nsending SIGTERM, will send SIGKILL in %d seconds", hndlr.uuid, hndlr.opts.TimeoutGrace)
+			emitEvent(title, body, hndlr.opts.Label, "error", hndlr)
+
+			signalProcessGroup(hndlr.cmd, syscall.SIGTERM)
+
+			killChan = time.After(time.Second * time.Duration(hndlr.opts.TimeoutGrace))
+		case <-killChan:
+			signalProcessGroup(hndlr.cmd, syscall.SIGKILL)
+		case sig := <-sigChan:
+			// keep waiting for the command to exit, so that we still hold
+			// the lock and can report on how the command finished
+			logger.Infof("received %v, forwarding it to the command", signalName(sig))
+
+			if res.signal == nil {
+				res.signal = sig
+			}
+
+			forwardSignal(hndlr.cmd, sig)
+		}
+	}
+
+	// a command that handled the signal and still exited cleanly wasn't
+	// aborted by it
+	if res.err == nil {
+		res.signal = nil
+	}
+
+	return res
+}
+
+// emit a dogstatsd event through the handler's emitter
 func emitEvent(title, body, label, alertType string, hndlr *cmdHandler) {
 	var buf bytes.Buffer
 
@@ -352,7 +810,7 @@ func emitEvent(title, body, label, alertType string, hndlr *cmdHandler) {
 		tags = append(tags, hndlr.opts.Tags...)
 	}
 
-	hndlr.gs.Event(title, body, fields, tags)
+	hndlr.emitter.Event(title, body, fields, tags)
 }
 
 // bailOut is for failures during logfile writing
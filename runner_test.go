@@ -16,6 +16,7 @@ import (
 	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/theckman/go-flock"
@@ -519,6 +520,11 @@ func (t *TestSuite) Test_handleCommand(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(retCode, Equals, 0)
 
+	// how long it waited for the lock
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(strings.HasPrefix(string(stat), "cronner.testCmd.lock_wait:"), Equals, true)
+
 	// clear the statsd return channel
 	_, ok = <-t.out
 	c.Assert(ok, Equals, true)
@@ -550,6 +556,10 @@ func (t *TestSuite) Test_handleCommand(c *C) {
 	c.Check(err.Error(), Equals, "timeout exceeded (1s) waiting for the file lock")
 	c.Check(retCode, Equals, 200)
 
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, "cronner.testCmd.lock_timeout:1|c")
+
 	//
 	// Test that warning Dogstatsd events are emitted if a
 	// command is taking too long to run
@@ -731,3 +741,196 @@ func (t *TestSuite) Test_writeOutput(c *C) {
 	c.Assert(err, IsNil)
 	c.Check(string(out), Equals, string(contents))
 }
+
+func (t *TestSuite) Test_handleCommand_timeout(c *C) {
+	h := &cmdHandler{
+		emitter:  t.h.emitter,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:        "testCmd",
+			LockDir:      c.MkDir(),
+			LogPath:      c.MkDir(),
+			Timeout:      1,
+			TimeoutGrace: 1,
+		},
+	}
+
+	//
+	// Test that a command is terminated once it exceeds the timeout
+	//
+	h.cmd = exec.Command("/bin/sleep", "10")
+
+	retCode, _, runTime, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "command timed out after 1 seconds")
+	c.Check(retCode, Equals, timeoutErrCode)
+	c.Check(runTime < 2000, Equals, true)
+
+	stat, ok := <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, "cronner.testCmd.timeout:1|c")
+
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(
+		string(stat),
+		Equals,
+		fmt.Sprintf(`_e{52,91}:Cron testCmd timed out after 1 seconds on brainbox01|UUID: %v\nsending SIGTERM, will send SIGKILL in 1 seconds|k:%v|s:cronner|t:error|#source_type:cronner,cronner_label_name:testCmd`, testCronnerUUID, testCronnerUUID),
+	)
+
+	// time
+	_, ok = <-t.out
+	c.Assert(ok, Equals, true)
+
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, "cronner.testCmd.exit_code:124|g")
+
+	//
+	// Test that SIGKILL is sent to the process group if SIGTERM is ignored
+	//
+	h.cmd = exec.Command("/bin/sh", "-c", `trap "" TERM; /bin/sleep 10; /bin/sleep 10`)
+
+	retCode, _, runTime, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, timeoutErrCode)
+	c.Check(runTime > 2000 && runTime < 3000, Equals, true)
+
+	for i := 0; i < 4; i++ {
+		_, ok = <-t.out
+		c.Assert(ok, Equals, true)
+	}
+
+	//
+	// Test that SIGKILL is sent to the process group as soon as the command
+	// exits, when something it started ignored SIGTERM
+	//
+	if _, statErr := os.Stat("/proc/self/stat"); statErr != nil {
+		c.Skip("no /proc to check for the process the command started")
+	}
+
+	pidFile := path.Join(c.MkDir(), "pid")
+	h.opts.TimeoutGrace = 10
+	h.cmd = exec.Command("/bin/sh", "-c", fmt.Sprintf(
+		`(trap "" TERM; exec /bin/sh -c 'echo $$ > %v; exec /bin/sleep 30' >/dev/null 2>&1) & /bin/sleep 10`, pidFile,
+	))
+
+	retCode, _, runTime, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, timeoutErrCode)
+	c.Check(runTime < 2000, Equals, true)
+
+	for i := 0; i < 4; i++ {
+		_, ok = <-t.out
+		c.Assert(ok, Equals, true)
+	}
+
+	pid, err := ioutil.ReadFile(pidFile)
+	c.Assert(err, IsNil)
+
+	// it may be left as a zombie if nothing reaps it
+	time.Sleep(time.Millisecond * 100)
+
+	procStat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%v/stat", strings.TrimSpace(string(pid))))
+	if err == nil {
+		fields := strings.Fields(string(procStat))
+		c.Check(fields[2], Equals, "Z")
+	}
+}
+
+func (t *TestSuite) Test_handleCommand_retries(c *C) {
+	workingDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  t.h.emitter,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:        "testCmd",
+			LockDir:      workingDir,
+			LogPath:      workingDir,
+			FailEvent:    true,
+			Retries:      2,
+			RetryBackoff: retryBackoffFixed,
+		},
+	}
+
+	//
+	// Test that a command that fails once is retried and succeeds
+	//
+	counter := path.Join(workingDir, "counter")
+	script := fmt.Sprintf(`n=$(cat %[1]s 2>/dev/null || echo 0); echo $((n+1)) > %[1]s; echo "attempt $n"; [ $n -ge 1 ]`, counter)
+
+	h.cmd = exec.Command("/bin/sh", "-c", script)
+
+	retCode, r, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(string(r), Equals, "attempt 1\n")
+
+	expected := []string{
+		"cronner.testCmd.attempt.time:",
+		"cronner.testCmd.attempt.exit_code:1|g|#cronner_attempt:1",
+		"cronner.testCmd.attempt.time:",
+		"cronner.testCmd.attempt.exit_code:0|g|#cronner_attempt:2",
+		"cronner.testCmd.time:",
+		"cronner.testCmd.exit_code:0|g",
+		"cronner.testCmd.attempts:2|g",
+	}
+
+	for _, prefix := range expected {
+		stat, ok := <-t.out
+		c.Assert(ok, Equals, true)
+		c.Check(strings.HasPrefix(string(stat), prefix), Equals, true, Commentf("%q does not start with %q", stat, prefix))
+	}
+
+	//
+	// Test that only the listed exit codes are retried
+	//
+	h.opts.RetryCodes = []int{75}
+	h.cmd = exec.Command("/bin/sh", "-c", "exit 3")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 3)
+
+	expected = []string{
+		"cronner.testCmd.attempt.time:",
+		"cronner.testCmd.attempt.exit_code:3|g|#cronner_attempt:1",
+		"cronner.testCmd.time:",
+		"cronner.testCmd.exit_code:3|g",
+		"cronner.testCmd.attempts:1|g",
+		"_e{",
+	}
+
+	for _, prefix := range expected {
+		stat, ok := <-t.out
+		c.Assert(ok, Equals, true)
+		c.Check(strings.HasPrefix(string(stat), prefix), Equals, true, Commentf("%q does not start with %q", stat, prefix))
+	}
+
+	//
+	// Test that the failure event is only sent once all attempts have failed
+	//
+	h.opts.RetryCodes = nil
+	h.cmd = exec.Command("/bin/sh", "-c", "exit 3")
+
+	retCode, _, runTime, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, 3)
+
+	for i := 0; i < 9; i++ {
+		stat, ok := <-t.out
+		c.Assert(ok, Equals, true)
+		c.Check(strings.HasPrefix(string(stat), "_e{"), Equals, false)
+	}
+
+	stat, ok := <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(
+		string(stat),
+		Equals,
+		fmt.Sprintf(`_e{52,85}:Cron testCmd failed in %.5f seconds on brainbox01|UUID: %v\nexit code: 3\nattempts: 3\noutput: (none)|k:%v|s:cronner|t:error|#source_type:cronner,cronner_label_name:testCmd`, runTime/1000, testCronnerUUID, testCronnerUUID),
+	)
+}
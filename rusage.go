@@ -0,0 +1,71 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// resourceUsage is the resource usage of the command, accumulated across all
+// of its attempts
+type resourceUsage struct {
+	userTime      time.Duration
+	systemTime    time.Duration
+	maxRSS        int64 // bytes
+	blockIn       int64
+	blockOut      int64
+	voluntaryCS   int64
+	involuntaryCS int64
+}
+
+// add accumulates the rusage of a finished process; the max RSS is the
+// largest seen rather than the total
+func (r *resourceUsage) add(state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return
+	}
+
+	r.userTime += time.Duration(ru.Utime.Nano())
+	r.systemTime += time.Duration(ru.Stime.Nano())
+
+	if rss := int64(ru.Maxrss) * rusageMaxRSSUnit; rss > r.maxRSS {
+		r.maxRSS = rss
+	}
+
+	r.blockIn += int64(ru.Inblock)
+	r.blockOut += int64(ru.Oublock)
+	r.voluntaryCS += int64(ru.Nvcsw)
+	r.involuntaryCS += int64(ru.Nivcsw)
+}
+
+// emit sends the resource usage as metrics; the CPU times are timings in
+// milliseconds, like the .time metric
+func (r *resourceUsage) emit(hndlr *cmdHandler, tags []string) {
+	label := hndlr.opts.Label
+
+	hndlr.emitter.Timing(fmt.Sprintf("%v.cpu.user", label), float64(r.userTime)/float64(time.Millisecond), tags)
+	hndlr.emitter.Timing(fmt.Sprintf("%v.cpu.system", label), float64(r.systemTime)/float64(time.Millisecond), tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.max_rss", label), float64(r.maxRSS), tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.block_in", label), float64(r.blockIn), tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.block_out", label), float64(r.blockOut), tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.ctx_switches.voluntary", label), float64(r.voluntaryCS), tags)
+	hndlr.emitter.Gauge(fmt.Sprintf("%v.ctx_switches.involuntary", label), float64(r.involuntaryCS), tags)
+}
+
+// String returns the resource usage formatted for the completion event body
+func (r *resourceUsage) String() string {
+	return fmt.Sprintf(
+		"cpu: user %.3fs, system %.3fs\nmax rss: %d bytes\nblock i/o: %d in, %d out\ncontext switches: %d voluntary, %d involuntary\n",
+		r.userTime.Seconds(), r.systemTime.Seconds(), r.maxRSS, r.blockIn, r.blockOut, r.voluntaryCS, r.involuntaryCS,
+	)
+}
@@ -0,0 +1,11 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+//
+// +build !darwin
+
+package main
+
+// rusageMaxRSSUnit is the size of the unit ru_maxrss is reported in, which on
+// Linux and the BSDs is kilobytes
+const rusageMaxRSSUnit = 1024
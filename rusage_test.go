@@ -0,0 +1,85 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_resourceUsage(c *C) {
+	var usage resourceUsage
+
+	// nothing to add if the command never ran
+	usage.add(nil)
+	c.Check(usage, DeepEquals, resourceUsage{})
+
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command("/bin/sh", "-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done")
+		c.Assert(cmd.Run(), IsNil)
+		usage.add(cmd.ProcessState)
+	}
+
+	c.Check(usage.userTime+usage.systemTime > 0, Equals, true)
+	c.Check(usage.maxRSS > 0, Equals, true)
+
+	usage = resourceUsage{
+		userTime:      time.Millisecond * 1500,
+		systemTime:    time.Millisecond * 250,
+		maxRSS:        4096,
+		blockIn:       1,
+		blockOut:      2,
+		voluntaryCS:   3,
+		involuntaryCS: 4,
+	}
+
+	c.Check(usage.String(), Equals, "cpu: user 1.500s, system 0.250s\nmax rss: 4096 bytes\nblock i/o: 1 in, 2 out\ncontext switches: 3 voluntary, 4 involuntary\n")
+}
+
+func (*TestSuite) Test_handleCommand_rusage(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:     "testCmd",
+			LockDir:   c.MkDir(),
+			LogPath:   c.MkDir(),
+			AllEvents: true,
+			Rusage:    true,
+		},
+		cmd: exec.Command("/bin/echo", "somevalue"),
+	}
+
+	_, _, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+
+	var names []string
+	for _, e := range r.emissions {
+		names = append(names, e.name)
+	}
+
+	c.Assert(names, HasLen, 11)
+	c.Check(names[3:10], DeepEquals, []string{
+		"testCmd.cpu.user",
+		"testCmd.cpu.system",
+		"testCmd.max_rss",
+		"testCmd.block_in",
+		"testCmd.block_out",
+		"testCmd.ctx_switches.voluntary",
+		"testCmd.ctx_switches.involuntary",
+	})
+
+	c.Check(r.emissions[5].value > 0, Equals, true)
+
+	body := r.emissions[10].body
+	c.Check(strings.HasPrefix(body, "UUID: "+testCronnerUUID+"\nexit code: 0\ncpu: user "), Equals, true)
+	c.Check(strings.HasSuffix(body, "output: somevalue\n"), Equals, true)
+}
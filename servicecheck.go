@@ -0,0 +1,42 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/tideland/golib/logger"
+)
+
+// the DogStatsD service check status values, which are the same as Nagios'
+const (
+	serviceCheckOK       = 0
+	serviceCheckWarning  = 1
+	serviceCheckCritical = 2
+	serviceCheckUnknown  = 3
+)
+
+// serviceCheckName returns the name of the job's service check; unlike the
+// metrics, the namespace is not prepended to service checks by the statsd
+// client so we need to do it ourselves
+func serviceCheckName(hndlr *cmdHandler) string {
+	return fmt.Sprintf("%v.%v.status", hndlr.opts.Namespace, hndlr.opts.Label)
+}
+
+// emitServiceCheck sends the status of the job as a DogStatsD service check,
+// if service checks were enabled
+func emitServiceCheck(hndlr *cmdHandler, status int, message string) {
+	if !hndlr.opts.ServiceCheck {
+		return
+	}
+
+	fields := map[string]string{
+		"service_check_message": message,
+	}
+
+	if err := hndlr.emitter.ServiceCheck(serviceCheckName(hndlr), status, fields, metricTags(hndlr)); err != nil {
+		logger.Errorf("failed to emit service check: %v", err)
+	}
+}
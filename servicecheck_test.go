@@ -0,0 +1,110 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+
+	"github.com/theckman/go-flock"
+
+	. "gopkg.in/check.v1"
+)
+
+func (t *TestSuite) Test_emitServiceCheck(c *C) {
+	h := &cmdHandler{
+		emitter: t.h.emitter,
+		opts: &binArgs{
+			Label:     "testCmd",
+			Namespace: "cronner",
+			Group:     "testgroup",
+		},
+	}
+
+	c.Check(serviceCheckName(h), Equals, "cronner.testCmd.status")
+
+	// disabled by default, so the next packet is the one after enabling it
+	emitServiceCheck(h, serviceCheckWarning, "ignored")
+
+	h.opts.ServiceCheck = true
+	emitServiceCheck(h, serviceCheckWarning, "still running")
+
+	stat, ok := <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, "_sc|cronner.testCmd.status|1|m:still running|#cronner_group:testgroup")
+}
+
+func (t *TestSuite) Test_handleCommand_serviceChecks(c *C) {
+	lockDir := c.MkDir()
+
+	h := &cmdHandler{
+		emitter:  t.h.emitter,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:        "testCmd",
+			Namespace:    "cronner",
+			LockDir:      lockDir,
+			LogPath:      c.MkDir(),
+			Lock:         true,
+			ServiceCheck: true,
+		},
+	}
+
+	//
+	// Test that a successful run is OK
+	//
+	h.cmd = exec.Command("/bin/echo", "somevalue")
+
+	_, _, runTime, err := handleCommand(h)
+	c.Assert(err, IsNil)
+
+	for i := 0; i < 2; i++ {
+		_, ok := <-t.out
+		c.Assert(ok, Equals, true)
+	}
+
+	stat, ok := <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, fmt.Sprintf("_sc|cronner.testCmd.status|0|m:Cron testCmd succeeded in %.5f seconds on brainbox01", runTime/1000))
+
+	//
+	// Test that a failed run is CRITICAL
+	//
+	h.cmd = exec.Command("/bin/sh", "-c", "exit 1")
+
+	_, _, runTime, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+
+	for i := 0; i < 2; i++ {
+		_, ok = <-t.out
+		c.Assert(ok, Equals, true)
+	}
+
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, fmt.Sprintf("_sc|cronner.testCmd.status|2|m:Cron testCmd failed in %.5f seconds on brainbox01", runTime/1000))
+
+	//
+	// Test that failing to get the lock is CRITICAL
+	//
+	lf := flock.NewFlock(path.Join(lockDir, "cronner-testCmd.lock"))
+
+	locked, err := lf.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	defer lf.Unlock()
+
+	h.cmd = exec.Command("/bin/echo", "somevalue")
+
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, fmt.Sprintf("_sc|cronner.testCmd.status|2|m:%v", err.Error()))
+}
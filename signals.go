@@ -0,0 +1,76 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/tideland/golib/logger"
+)
+
+// forwardedSignals are the signals cronner traps while the command is running,
+// so they can be passed on to the command instead of killing cronner
+var forwardedSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+}
+
+// signalName returns the conventional name of a signal (e.g., SIGTERM),
+// falling back to its description for signals we don't know the name of
+func signalName(sig os.Signal) string {
+	if s, ok := sig.(syscall.Signal); ok {
+		if name, ok := signalNames[s]; ok {
+			return name
+		}
+	}
+
+	return sig.String()
+}
+
+// signalExitCode returns the exit code a shell would report for a command
+// killed by sig: 128 + the signal number
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+
+	return intErrCode
+}
+
+// signalProcessGroup sends sig to the process group of the command, which is
+// only its own when the command was started with Setpgid
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if cmd.Process == nil {
+		return
+	}
+
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && err != syscall.ESRCH {
+		logger.Errorf("failed to send %v to process group %d: %v", signalName(sig), cmd.Process.Pid, err)
+	}
+}
+
+// forwardSignal passes sig on to the command, or to its whole process group
+// if it was started in its own
+func forwardSignal(cmd *exec.Cmd, sig os.Signal) {
+	if cmd.Process == nil {
+		return
+	}
+
+	if s, ok := sig.(syscall.Signal); ok && cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		signalProcessGroup(cmd, s)
+		return
+	}
+
+	if err := cmd.Process.Signal(sig); err != nil {
+		logger.Errorf("failed to forward %v to the command: %v", signalName(sig), err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_signalName(c *C) {
+	c.Check(signalName(syscall.SIGTERM), Equals, "SIGTERM")
+	c.Check(signalName(syscall.SIGHUP), Equals, "SIGHUP")
+	c.Check(signalName(syscall.SIGUSR1), Equals, syscall.SIGUSR1.String())
+}
+
+func (*TestSuite) Test_signalExitCode(c *C) {
+	c.Check(signalExitCode(syscall.SIGINT), Equals, 130)
+	c.Check(signalExitCode(syscall.SIGTERM), Equals, 143)
+}
+
+func (t *TestSuite) Test_handleCommand_forwardsSignals(c *C) {
+	h := &cmdHandler{
+		emitter:  t.h.emitter,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:   "testCmd",
+			LockDir: c.MkDir(),
+			LogPath: c.MkDir(),
+			Lock:    true,
+		},
+	}
+
+	// the command exits with a distinct return code when it receives SIGTERM,
+	// so we can tell that it was forwarded
+	h.cmd = exec.Command("/bin/sh", "-c", `trap "exit 42" TERM; /bin/sleep 10 & wait`)
+
+	go func() {
+		time.Sleep(time.Millisecond * 500)
+		syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	retCode, _, runTime, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "command aborted by SIGTERM")
+	c.Check(retCode, Equals, 42)
+	c.Check(runTime < 5000, Equals, true)
+
+	// time
+	_, ok := <-t.out
+	c.Assert(ok, Equals, true)
+
+	stat, ok := <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(string(stat), Equals, "cronner.testCmd.exit_code:42|g")
+
+	// the event is sent even though no event flags were set
+	stat, ok = <-t.out
+	c.Assert(ok, Equals, true)
+	c.Check(
+		string(stat),
+		Equals,
+		fmt.Sprintf(`_e{64,107}:Cron testCmd aborted by SIGTERM in %.5f seconds on brainbox01|UUID: %v\nexit code: 42\nmore: command aborted by SIGTERM\noutput: (none)|k:%v|s:cronner|t:error|#source_type:cronner,cronner_label_name:testCmd`, runTime/1000, testCronnerUUID, testCronnerUUID),
+	)
+}
+
+func (*TestSuite) Test_handleCommand_signalOutcome(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:   "testCmd",
+			LockDir: c.MkDir(),
+		},
+	}
+
+	sendSignal := func(sig syscall.Signal) {
+		go func() {
+			time.Sleep(time.Millisecond * 500)
+			syscall.Kill(os.Getpid(), sig)
+		}()
+	}
+
+	// a command killed by the signal is aborted, with the exit code a shell
+	// would give it
+	h.cmd = exec.Command("/bin/sleep", "10")
+	sendSignal(syscall.SIGTERM)
+
+	retCode, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "command aborted by SIGTERM")
+	c.Check(retCode, Equals, 143)
+
+	// a command that handles the signal and exits cleanly wasn't aborted
+	r.emissions = nil
+	h.cmd = exec.Command("/bin/sh", "-c", `trap "exit 0" HUP; /bin/sleep 10 & wait`)
+	sendSignal(syscall.SIGHUP)
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+
+	for _, e := range r.recorded() {
+		c.Check(strings.Contains(e.name, "aborted"), Equals, false)
+	}
+
+	// the command runs in its own process group, so that a signal sent to
+	// cronner's whole group, like a ^C from the terminal, doesn't reach it
+	// both directly and when it's forwarded
+	if _, statErr := os.Stat("/proc/self/stat"); statErr != nil {
+		c.Skip("no /proc to read the process group from")
+	}
+
+	h.cmd = exec.Command("/bin/sh", "-c", `read -r pid comm state ppid pgrp rest < /proc/$$/stat; [ "$pid" = "$pgrp" ]`)
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+}
@@ -0,0 +1,119 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/theckman/go-flock"
+)
+
+// slotRetryInterval is how often a run waiting for a free slot checks for one
+//
+// blocking on the lock of every slot at once would leave the slots we didn't
+// get still being waited on, and briefly held whenever they're freed, until
+// cronner exits; that gets in the way of other runs looking for a free slot,
+// so the slots are only ever checked under the guard lock instead
+var slotRetryInterval = time.Millisecond * 100
+
+// slotEnvVar is the environment variable the index of the slot the command is
+// running in is passed in, when --max-concurrent is used
+const slotEnvVar = "CRONNER_SLOT"
+
+// slotLockPath returns the path of the lock file for slot i of the job
+func slotLockPath(hndlr *cmdHandler, i int) string {
+	return path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.slot-%d.lock", hndlr.opts.Label, i))
+}
+
+// trySlots makes a single attempt at getting one of the --max-concurrent slots
+// of the job. It returns the lock and index of the slot it got, or nil if they
+// were all in use, and how many slots are in use including its own.
+//
+// the slots are scanned while holding a guard lock, so that the slots found to
+// be free can be briefly locked to check them without getting in the way of
+// another cronner looking for a free slot at the same time
+func trySlots(hndlr *cmdHandler) (*flock.Flock, int, int, error) {
+	guard := flock.NewFlock(path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.slots.lock", hndlr.opts.Label)))
+
+	if err := guard.Lock(); err != nil {
+		return nil, -1, 0, fmt.Errorf("failed to obtain lock on '%v': %v", guard, err)
+	}
+
+	defer guard.Unlock()
+
+	var slot *flock.Flock
+	index := -1
+	inUse := 0
+
+	for i := 0; i < int(hndlr.opts.MaxConcurrent); i++ {
+		lock := flock.NewFlock(slotLockPath(hndlr, i))
+
+		locked, err := lock.TryLock()
+		if err != nil {
+			if slot != nil {
+				slot.Unlock()
+			}
+			return nil, -1, 0, fmt.Errorf("failed to obtain lock on '%v': %v", lock, err)
+		}
+
+		switch {
+		case !locked:
+			inUse++
+		case slot == nil:
+			slot, index = lock, i
+			inUse++
+		default:
+			// only checking whether it's free
+			lock.Unlock()
+		}
+	}
+
+	return slot, index, inUse, nil
+}
+
+// acquireSlot gets one of the --max-concurrent slots of the job, waiting up to
+// --wait-secs for one to be free if they're all in use, or without a limit
+// with --on-locked=queue; it returns the lock of the slot, its index, and how
+// many slots are in use including this one
+func acquireSlot(hndlr *cmdHandler) (*flock.Flock, int, int, error) {
+	slot, index, inUse, err := trySlots(hndlr)
+
+	if err != nil || slot != nil {
+		return slot, index, inUse, err
+	}
+
+	if hndlr.opts.WaitSeconds == 0 && hndlr.opts.OnLocked != onLockedQueue {
+		return nil, -1, inUse, &lockBusyError{fmt.Sprintf("failed to obtain a slot for '%v': all %d slots are in use", hndlr.opts.Label, hndlr.opts.MaxConcurrent)}
+	}
+
+	var deadline time.Time
+
+	if hndlr.opts.WaitSeconds > 0 {
+		deadline = time.Now().Add(time.Second * time.Duration(hndlr.opts.WaitSeconds))
+	}
+
+	for {
+		wait := slotRetryInterval
+
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, -1, inUse, &lockBusyError{fmt.Sprintf("timeout exceeded (%ds) waiting for a free slot", hndlr.opts.WaitSeconds)}
+			}
+
+			if left < wait {
+				wait = left
+			}
+		}
+
+		time.Sleep(wait)
+
+		if slot, index, inUse, err = trySlots(hndlr); err != nil || slot != nil {
+			return slot, index, inUse, err
+		}
+	}
+}
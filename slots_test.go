@@ -0,0 +1,154 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/theckman/go-flock"
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_acquireSlot(c *C) {
+	h := &cmdHandler{
+		opts: &binArgs{
+			Label:         "testCmd",
+			LockDir:       c.MkDir(),
+			MaxConcurrent: 3,
+		},
+	}
+
+	first, index, inUse, err := acquireSlot(h)
+	c.Assert(err, IsNil)
+	c.Check(index, Equals, 0)
+	c.Check(inUse, Equals, 1)
+
+	second, index, inUse, err := acquireSlot(h)
+	c.Assert(err, IsNil)
+	c.Check(index, Equals, 1)
+	c.Check(inUse, Equals, 2)
+
+	// freeing a slot that isn't the last makes it the next one used, and
+	// the slots after it are still counted
+	c.Assert(first.Unlock(), IsNil)
+
+	first, index, inUse, err = acquireSlot(h)
+	c.Assert(err, IsNil)
+	c.Check(index, Equals, 0)
+	c.Check(inUse, Equals, 2)
+
+	third, index, inUse, err := acquireSlot(h)
+	c.Assert(err, IsNil)
+	c.Check(index, Equals, 2)
+	c.Check(inUse, Equals, 3)
+
+	// all of the slots are in use
+	_, _, inUse, err = acquireSlot(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "failed to obtain a slot for 'testCmd': all 3 slots are in use")
+	c.Check(inUse, Equals, 3)
+
+	// waiting for a slot to be freed
+	h.opts.WaitSeconds = 5
+
+	freed := second
+
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		freed.Unlock()
+	}()
+
+	start := time.Now()
+	second, index, inUse, err = acquireSlot(h)
+	c.Assert(err, IsNil)
+	c.Check(index, Equals, 1)
+	c.Check(inUse, Equals, 3)
+
+	// the slot is taken soon after it's freed
+	c.Check(time.Since(start) < time.Millisecond*500, Equals, true)
+
+	// and timing out
+	h.opts.WaitSeconds = 1
+
+	start = time.Now()
+	_, _, _, err = acquireSlot(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, "timeout exceeded (1s) waiting for a free slot")
+	c.Check(time.Since(start) >= time.Second, Equals, true)
+
+	// the runs that waited aren't left holding on to the slots they didn't
+	// get, so a freed slot is there for the next run
+	h.opts.WaitSeconds = 0
+	c.Assert(third.Unlock(), IsNil)
+
+	for i := 0; i < 20; i++ {
+		slot, index, _, err := acquireSlot(h)
+		c.Assert(err, IsNil)
+		c.Check(index, Equals, 2)
+		c.Check(slot.Unlock(), IsNil)
+	}
+
+	for _, slot := range []*flock.Flock{first, second} {
+		c.Check(slot.Unlock(), IsNil)
+	}
+}
+
+func (*TestSuite) Test_handleCommand_maxConcurrent(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:         "testCmd",
+			LockDir:       c.MkDir(),
+			MaxConcurrent: 2,
+			FailEvent:     true,
+		},
+		cmd: exec.Command("/bin/sh", "-c", "echo $CRONNER_SLOT"),
+	}
+
+	// hold the first slot, as another run would
+	held := flock.NewFlock(slotLockPath(h, 0))
+	locked, err := held.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	defer held.Unlock()
+
+	retCode, out, _, err := handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(retCode, Equals, 0)
+	c.Check(strings.TrimSpace(string(out)), Equals, "1")
+
+	c.Assert(len(r.emissions) > 2, Equals, true)
+	c.Check(r.emissions[0].kind, Equals, "timing")
+	c.Check(r.emissions[0].name, Equals, "testCmd.slot_wait")
+	c.Check(r.emissions[1], DeepEquals, emission{kind: "gauge", name: "testCmd.slots_in_use", value: 2, tags: []string{}})
+
+	// the slot is released afterwards
+	slot := flock.NewFlock(slotLockPath(h, 1))
+	locked, err = slot.TryLock()
+	c.Assert(err, IsNil)
+	c.Check(locked, Equals, true)
+	c.Check(slot.Unlock(), IsNil)
+
+	// and all of the slots being in use fails the run
+	other := flock.NewFlock(slotLockPath(h, 1))
+	locked, err = other.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(locked, Equals, true)
+
+	defer other.Unlock()
+
+	h.cmd = exec.Command("/bin/true")
+
+	retCode, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(retCode, Equals, intErrCode)
+}
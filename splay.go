@@ -0,0 +1,56 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// With --splay, cronner waits a random delay of up to the --splay duration
+// before running the command, so that jobs started at the same time on many
+// hosts don't all hit whatever they share at once. With --splay-by-host the
+// delay comes from a hash of the hostname and label instead, so each host
+// runs the job at the same offset every time.
+
+// parseSplay parses the --splay duration, which is a Go duration like 10m or
+// a number of seconds
+func parseSplay(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("--splay value '%v' is invalid, it must be a duration like 90s or 10m, or a number of seconds", s)
+	}
+
+	return d, nil
+}
+
+// splayDelay returns how long to wait before running the command, which is 0
+// without --splay
+func splayDelay(hndlr *cmdHandler) time.Duration {
+	max, err := parseSplay(hndlr.opts.Splay)
+	if err != nil || max <= 0 {
+		return 0
+	}
+
+	if hndlr.opts.SplayByHost {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%v\x00%v", hndlr.hostname, hndlr.opts.Label)
+
+		return time.Duration(h.Sum64() % uint64(max))
+	}
+
+	return time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(max)))
+}
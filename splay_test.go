@@ -0,0 +1,99 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_parseSplay(c *C) {
+	tests := []struct {
+		value string
+		splay time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"90", time.Second * 90},
+		{"10m", time.Minute * 10},
+		{"1h30m", time.Minute * 90},
+	}
+
+	for _, test := range tests {
+		splay, err := parseSplay(test.value)
+		c.Assert(err, IsNil)
+		c.Check(splay, Equals, test.splay)
+	}
+
+	for _, value := range []string{"-5m", "soon", "10 minutes"} {
+		_, err := parseSplay(value)
+		c.Assert(err, Not(IsNil))
+		c.Check(err.Error(), Equals, fmt.Sprintf("--splay value '%v' is invalid, it must be a duration like 90s or 10m, or a number of seconds", value))
+	}
+}
+
+func (*TestSuite) Test_splayDelay(c *C) {
+	h := &cmdHandler{
+		hostname: "brainbox01",
+		opts:     &binArgs{Label: "testCmd"},
+	}
+
+	c.Check(splayDelay(h), Equals, time.Duration(0))
+
+	h.opts.Splay = "1h"
+
+	for i := 0; i < 10; i++ {
+		delay := splayDelay(h)
+		c.Check(delay >= 0 && delay < time.Hour, Equals, true, Commentf("delay: %v", delay))
+	}
+
+	// the delay from the hostname and label is the same every time, and
+	// differs between hosts
+	h.opts.SplayByHost = true
+	delay := splayDelay(h)
+
+	c.Check(delay >= 0 && delay < time.Hour, Equals, true, Commentf("delay: %v", delay))
+	c.Check(splayDelay(h), Equals, delay)
+
+	h.hostname = "brainbox02"
+	c.Check(splayDelay(h), Not(Equals), delay)
+}
+
+func (*TestSuite) Test_handleCommand_splay(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:       "testCmd",
+			LockDir:     c.MkDir(),
+			AllEvents:   true,
+			Splay:       "200ms",
+			SplayByHost: true,
+		},
+		cmd: exec.Command("/bin/true"),
+	}
+
+	delay := splayDelay(h)
+
+	start := time.Now()
+
+	_, _, runTime, err := handleCommand(h)
+	c.Assert(err, IsNil)
+
+	// the delay was waited out, but isn't part of the run time
+	c.Check(time.Since(start) >= delay, Equals, true)
+	c.Check(runTime < float64(delay)/float64(time.Millisecond), Equals, true, Commentf("run time: %v, delay: %v", runTime, delay))
+
+	c.Assert(len(r.emissions) > 2, Equals, true)
+	c.Check(r.emissions[0].kind, Equals, "event")
+	c.Check(r.emissions[0].body, Equals, fmt.Sprintf("UUID: %v\nsplay: %v\n", testCronnerUUID, delay.Round(time.Millisecond)))
+	c.Check(r.emissions[1], DeepEquals, emission{kind: "timing", name: "testCmd.splay", value: float64(delay) / float64(time.Millisecond), tags: []string{}})
+}
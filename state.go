@@ -0,0 +1,100 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	stateResultSuccess = "success"
+	stateResultFailure = "failure"
+)
+
+// runState is what's remembered about the previous runs of a job, so that
+// alerting can be based on more than just the current run
+type runState struct {
+	LastResult          string    `json:"last_result"`
+	LastExitCode        int       `json:"last_exit_code"`
+	LastUUID            string    `json:"last_uuid"`
+	LastRun             time.Time `json:"last_run"`
+	LastSuccess         time.Time `json:"last_success"`
+	ConsecutiveFailures uint64    `json:"consecutive_failures"`
+}
+
+// trackState returns whether any of the options that need the state of the
+// previous runs were given
+func trackState(opts *binArgs) bool {
+	return opts.AlertAfterFailures > 0 || opts.EventRecovery
+}
+
+// stateFilename returns the path of the state file for the job, which lives in
+// the lock directory next to the lock file
+func stateFilename(hndlr *cmdHandler) string {
+	return path.Join(hndlr.opts.LockDir, fmt.Sprintf("cronner-%v.state", hndlr.opts.Label))
+}
+
+// readState loads the state of the previous runs; it's not an error for the
+// file to not exist, as that's the case on the first run
+func readState(filename string) (*runState, error) {
+	state := &runState{}
+
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, fmt.Errorf("failed to read state file '%v': %v", filename, err)
+	}
+
+	if err = json.Unmarshal(contents, state); err != nil {
+		return &runState{}, fmt.Errorf("failed to parse state file '%v': %v", filename, err)
+	}
+
+	return state, nil
+}
+
+// update records the result of a run
+func (s *runState) update(uuid string, ret int, end time.Time) {
+	s.LastExitCode = ret
+	s.LastUUID = uuid
+	s.LastRun = end
+
+	if ret == 0 {
+		s.LastResult = stateResultSuccess
+		s.LastSuccess = end
+		s.ConsecutiveFailures = 0
+	} else {
+		s.LastResult = stateResultFailure
+		s.ConsecutiveFailures++
+	}
+}
+
+// write saves the state, first writing it to a temporary file in the same
+// directory and then renaming it into place so a crash can't corrupt it
+func (s *runState) write(filename string) error {
+	contents, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	return writeFileAtomic(filename, append(contents, '\n'), 0600)
+}
+
+// alertThreshold returns how many consecutive failures there need to be
+// before the failure event is emitted; it's then emitted for every failure
+// until the job succeeds
+func alertThreshold(opts *binArgs) uint64 {
+	if opts.AlertAfterFailures > 1 {
+		return opts.AlertAfterFailures
+	}
+
+	return 1
+}
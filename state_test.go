@@ -0,0 +1,130 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_runState(c *C) {
+	filename := path.Join(c.MkDir(), "cronner-testCmd.state")
+
+	// a missing state file is an empty state
+	state, err := readState(filename)
+	c.Assert(err, IsNil)
+	c.Check(*state, DeepEquals, runState{})
+
+	end := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	state.update("uuid1", 0, end)
+	state.update("uuid2", 3, end.Add(time.Minute))
+	state.update("uuid3", 1, end.Add(time.Minute*2))
+
+	c.Check(state.LastResult, Equals, stateResultFailure)
+	c.Check(state.LastExitCode, Equals, 1)
+	c.Check(state.LastUUID, Equals, "uuid3")
+	c.Check(state.LastRun.Equal(end.Add(time.Minute*2)), Equals, true)
+	c.Check(state.LastSuccess.Equal(end), Equals, true)
+	c.Check(state.ConsecutiveFailures, Equals, uint64(2))
+
+	c.Assert(state.write(filename), IsNil)
+
+	read, err := readState(filename)
+	c.Assert(err, IsNil)
+	c.Check(read.LastResult, Equals, stateResultFailure)
+	c.Check(read.LastUUID, Equals, "uuid3")
+	c.Check(read.LastSuccess.Equal(end), Equals, true)
+	c.Check(read.ConsecutiveFailures, Equals, uint64(2))
+
+	read.update("uuid4", 0, end.Add(time.Minute*3))
+	c.Check(read.LastResult, Equals, stateResultSuccess)
+	c.Check(read.ConsecutiveFailures, Equals, uint64(0))
+
+	// a corrupt state file is reported, but still gives a usable state
+	c.Assert(ioutil.WriteFile(filename, []byte("{"), 0644), IsNil)
+
+	state, err = readState(filename)
+	c.Check(err, Not(IsNil))
+	c.Check(*state, DeepEquals, runState{})
+}
+
+func (*TestSuite) Test_handleCommand_alertAfterFailures(c *C) {
+	r := &recordingEmitter{}
+
+	h := &cmdHandler{
+		emitter:  r,
+		hostname: "brainbox01",
+		uuid:     testCronnerUUID,
+		opts: &binArgs{
+			Label:              "testCmd",
+			LockDir:            c.MkDir(),
+			FailEvent:          true,
+			AlertAfterFailures: 2,
+			EventRecovery:      true,
+		},
+	}
+
+	events := func() []emission {
+		var e []emission
+		for _, em := range r.emissions {
+			if em.kind == "event" {
+				e = append(e, em)
+			}
+		}
+		return e
+	}
+
+	// the first failure doesn't emit an event
+	h.cmd = exec.Command("/bin/false")
+	_, _, _, err := handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Check(events(), HasLen, 0)
+	c.Check(r.emissions[2], DeepEquals, emission{kind: "gauge", name: "testCmd.consecutive_failures", value: 1, tags: []string{}})
+
+	// the second one does
+	h.cmd = exec.Command("/bin/false")
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Assert(events(), HasLen, 1)
+	c.Check(events()[0].body, Equals, fmt.Sprintf("UUID: %v\nexit code: 1\nconsecutive failures: 2\noutput: (none)", testCronnerUUID))
+
+	// and so does every one after that, until it succeeds
+	h.cmd = exec.Command("/bin/false")
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+	c.Assert(events(), HasLen, 2)
+	c.Check(events()[1].body, Equals, fmt.Sprintf("UUID: %v\nexit code: 1\nconsecutive failures: 3\noutput: (none)", testCronnerUUID))
+
+	// the success after them is a recovery
+	r.emissions = nil
+	h.cmd = exec.Command("/bin/true")
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Assert(events(), HasLen, 1)
+	c.Check(events()[0].name, Equals, "Cron testCmd recovered after 3 failures on brainbox01")
+	c.Check(events()[0].body, Equals, fmt.Sprintf("UUID: %v\nexit code: 0\n", testCronnerUUID))
+
+	state, err := readState(stateFilename(h))
+	c.Assert(err, IsNil)
+	c.Check(state.LastResult, Equals, stateResultSuccess)
+	c.Check(state.ConsecutiveFailures, Equals, uint64(0))
+
+	// a single failure, which never alerted, doesn't get a recovery event
+	h.cmd = exec.Command("/bin/false")
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, Not(IsNil))
+
+	r.emissions = nil
+	h.cmd = exec.Command("/bin/true")
+	_, _, _, err = handleCommand(h)
+	c.Assert(err, IsNil)
+	c.Check(events(), HasLen, 0)
+}
@@ -0,0 +1,431 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/tideland/golib/logger"
+)
+
+const (
+	validateTypeAuto    = "auto"
+	validateTypeConfig  = "config"
+	validateTypeCrontab = "crontab"
+)
+
+// accessWriteOK is the W_OK mode of access(2)
+const accessWriteOK = 0x2
+
+// validateArgs are the arguments of the validate subcommand
+type validateArgs struct {
+	Type string `long:"type" default:"auto" value-name:"<auto|config|crontab>" description:"the type of the files; auto treats a file with a [table] header as a config file, and anything else as a crontab"`
+	Args struct {
+		Files []string `positional-arg-name:"file"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// diagnostic is a problem found in a file by the validate subcommand
+type diagnostic struct {
+	filename string
+	line     int
+	msg      string
+}
+
+func (d diagnostic) String() string {
+	return fmt.Sprintf("%v:%d: error: %v", d.filename, d.line, d.msg)
+}
+
+// validateCmd is the validate subcommand, which checks the cronner invocations
+// in config files and crontabs; it prints a diagnostic for each problem, and
+// returns a non-zero exit code if there were any
+func validateCmd(args []string, stdout, stderr io.Writer) int {
+	v := &validateArgs{}
+
+	p := flags.NewParser(v, flags.HelpFlag)
+	p.Name = "cronner validate"
+
+	if _, err := p.ParseArgs(args); err != nil {
+		if errType, ok := err.(*flags.Error); ok && errType.Type == flags.ErrHelp {
+			fmt.Fprint(stdout, err.Error())
+			return 0
+		}
+
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		return 1
+	}
+
+	if len(v.Args.Files) == 0 {
+		fmt.Fprintf(stderr, "error: at least one file to validate is required\n")
+		return 1
+	}
+
+	switch v.Type {
+	case validateTypeAuto, validateTypeConfig, validateTypeCrontab:
+	default:
+		fmt.Fprintf(stderr, "error: %v is not a known file type, try auto, config, or crontab\n", v.Type)
+		return 1
+	}
+
+	// parsing the arguments sets the log level, so put it back afterwards
+	defer logger.SetLevel(logger.Level())
+
+	var diags []diagnostic
+
+	for _, filename := range v.Args.Files {
+		diags = append(diags, validateFile(filename, v.Type)...)
+	}
+
+	for _, d := range diags {
+		fmt.Fprintln(stdout, d)
+	}
+
+	if len(diags) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// validateFile validates a config file or crontab
+func validateFile(filename, fileType string) []diagnostic {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return []diagnostic{{filename, 0, err.Error()}}
+	}
+
+	if fileType == validateTypeAuto {
+		fileType = validateTypeCrontab
+
+		if isConfigFile(contents) {
+			fileType = validateTypeConfig
+		}
+	}
+
+	if fileType == validateTypeConfig {
+		return validateConfig(filename, contents)
+	}
+
+	return validateCrontab(filename, contents)
+}
+
+// isConfigFile returns whether contents looks like a config file rather than a
+// crontab, by having a table header
+func isConfigFile(contents []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+
+	for scanner.Scan() {
+		if strings.HasPrefix(strings.TrimSpace(scanner.Text()), "[") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateConfig validates every job in the config file
+func validateConfig(filename string, contents []byte) []diagnostic {
+	cfg, err := parseConfig(filename, bytes.NewReader(contents))
+	if err != nil {
+		return []diagnostic{configDiagnostic(filename, 0, err)}
+	}
+
+	jobs := make([]string, 0, len(cfg.jobs))
+	for job := range cfg.jobs {
+		jobs = append(jobs, job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return cfg.jobLines[jobs[i]] < cfg.jobLines[jobs[j]] })
+
+	var diags []diagnostic
+
+	for _, job := range jobs {
+		line := cfg.jobLines[job]
+
+		options, command, err := cfg.jobOptions(job)
+		if err != nil {
+			diags = append(diags, configDiagnostic(filename, line, err))
+			continue
+		}
+
+		msgs := validateInvocation(jobInvocation(options, command, -1))
+
+		for _, msg := range msgs {
+			diags = append(diags, diagnostic{filename, optionLine(options, command, msgs, msg, line), fmt.Sprintf("job '%v': %v", job, msg)})
+		}
+	}
+
+	return diags
+}
+
+// jobInvocation returns the cronner invocation equivalent to the settings of a
+// job, leaving out the setting at index skip if it isn't -1
+func jobInvocation(options []configOption, command []string, skip int) []string {
+	args := []string{"cronner"}
+
+	for i, option := range options {
+		if i != skip {
+			args = append(args, option.args...)
+		}
+	}
+
+	if len(command) > 0 {
+		args = append(append(args, "--"), command...)
+	}
+
+	return args
+}
+
+// optionLine returns the line of the setting that the validation error msg,
+// one of msgs, is about. That's the one that makes it go away when it's left
+// out, preferably without causing any other errors, as leaving out a required
+// setting like the label can stop the validation before it gets to msg. If
+// there isn't one, like when a setting is missing, it returns line.
+func optionLine(options []configOption, command []string, msgs []string, msg string, line int) int {
+	for _, strict := range []bool{true, false} {
+		for i, option := range options {
+			ok := true
+
+			for _, m := range validateInvocation(jobInvocation(options, command, i)) {
+				if m == msg || (strict && !isOneOf(m, msgs)) {
+					ok = false
+					break
+				}
+			}
+
+			if ok {
+				return option.line
+			}
+		}
+	}
+
+	return line
+}
+
+// configDiagnostic converts an error from parsing the config file to a
+// diagnostic, using its line number if it has one
+func configDiagnostic(filename string, line int, err error) diagnostic {
+	if cfgErr, ok := err.(*configError); ok {
+		if cfgErr.line > 0 {
+			line = cfgErr.line
+		}
+
+		return diagnostic{filename, line, cfgErr.msg}
+	}
+
+	return diagnostic{filename, line, err.Error()}
+}
+
+// isOneOf returns whether s is one of the strings
+func isOneOf(s string, strs []string) bool {
+	for _, str := range strs {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateCrontab validates every cronner invocation in the crontab
+func validateCrontab(filename string, contents []byte) []diagnostic {
+	var diags []diagnostic
+	var lineNum int
+
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+
+	for scanner.Scan() {
+		lineNum++
+
+		args, err := cronnerInvocation(scanner.Text())
+		if err != nil {
+			diags = append(diags, diagnostic{filename, lineNum, err.Error()})
+			continue
+		}
+
+		if args == nil {
+			continue
+		}
+
+		for _, msg := range validateInvocation(args) {
+			diags = append(diags, diagnostic{filename, lineNum, msg})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		diags = append(diags, diagnostic{filename, lineNum, err.Error()})
+	}
+
+	return diags
+}
+
+// cronnerInvocation finds the cronner invocation in a crontab line, and
+// returns its arguments; it returns nil if the line doesn't run cronner
+func cronnerInvocation(line string) ([]string, error) {
+	line = strings.TrimSpace(line)
+
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+
+	words, err := shellWords(line)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, word := range words {
+		if path.Base(word.text) != "cronner" || word.operator {
+			continue
+		}
+
+		args := []string{word.text}
+
+		for _, arg := range words[i+1:] {
+			if arg.operator {
+				break
+			}
+
+			args = append(args, arg.text)
+		}
+
+		return args, nil
+	}
+
+	return nil, nil
+}
+
+// shellWord is a word from a shell command line; operator is whether it's an
+// unquoted control operator or redirection, which ends a command
+type shellWord struct {
+	text     string
+	operator bool
+}
+
+// shellWords splits a shell command line into words, handling quoting and
+// escaping; it's not a full shell parser, but it's good enough to find the
+// arguments of a simple command
+func shellWords(line string) ([]shellWord, error) {
+	var words []shellWord
+	var buf bytes.Buffer
+	var inWord, quoted bool
+
+	endWord := func() {
+		if !inWord {
+			return
+		}
+
+		text := buf.String()
+		words = append(words, shellWord{text: text, operator: !quoted && isShellOperator(text)})
+
+		buf.Reset()
+		inWord, quoted = false, false
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == '\\' && i+1 < len(line):
+			i++
+			buf.WriteByte(line[i])
+			inWord, quoted = true, true
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated %c quote", c)
+			}
+
+			buf.WriteString(line[i+1 : i+1+end])
+			inWord, quoted = true, true
+			i += end + 1
+		case c == ';' || c == '|' || c == '&':
+			endWord()
+			words = append(words, shellWord{text: string(c), operator: true})
+		default:
+			buf.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	endWord()
+
+	return words, nil
+}
+
+// isShellOperator returns whether the unquoted word is a redirection, like
+// >/dev/null or 2>
+func isShellOperator(word string) bool {
+	word = strings.TrimLeft(word, "0123456789")
+	return strings.HasPrefix(word, ">") || strings.HasPrefix(word, "<")
+}
+
+// validateInvocation validates the arguments of a cronner invocation, with
+// args[0] being the cronner binary, and returns the problems found
+func validateInvocation(args []string) []string {
+	opts := &binArgs{}
+
+	output, err := opts.parse(args)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	// asking for the help or version doesn't run anything
+	if len(output) > 0 {
+		return nil
+	}
+
+	var problems []string
+
+	if _, err = resolveCredential(opts); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if (opts.Lock && opts.LockBackend != lockBackendRedis) || opts.MaxConcurrent > 0 || trackState(opts) {
+		if msg := checkWritableDir("lock", opts.LockDir); len(msg) > 0 {
+			problems = append(problems, msg)
+		}
+	}
+
+	if opts.LogFail {
+		if msg := checkWritableDir("log", opts.LogPath); len(msg) > 0 {
+			problems = append(problems, msg)
+		}
+	}
+
+	return problems
+}
+
+// checkWritableDir returns why dir can't be used to create files in, if it
+// can't be; what is the name of the directory used in the message
+func checkWritableDir(what, dir string) string {
+	stat, err := os.Stat(dir)
+
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Sprintf("%v directory '%v' does not exist", what, dir)
+	case err != nil:
+		return fmt.Sprintf("%v directory '%v' can't be used: %v", what, dir, err)
+	case !stat.IsDir():
+		return fmt.Sprintf("%v directory '%v' is not a directory", what, dir)
+	}
+
+	if err = syscall.Access(dir, accessWriteOK); err != nil {
+		return fmt.Sprintf("%v directory '%v' is not writable", what, dir)
+	}
+
+	return ""
+}
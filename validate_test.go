@@ -0,0 +1,168 @@
+// Copyright 2016-2017 Tim Heckman
+// Use of this source code is governed by the BSD 3-Clause
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+func (*TestSuite) Test_shellWords(c *C) {
+	words, err := shellWords(`cronner -l "my job" -t 'a:b' -- /bin/echo it\'s >/dev/null 2>&1; echo done`)
+	c.Assert(err, IsNil)
+
+	c.Check(words, DeepEquals, []shellWord{
+		{text: "cronner"},
+		{text: "-l"},
+		{text: "my job"},
+		{text: "-t"},
+		{text: "a:b"},
+		{text: "--"},
+		{text: "/bin/echo"},
+		{text: "it's"},
+		{text: ">/dev/null", operator: true},
+		{text: "2>", operator: true},
+		{text: "&", operator: true},
+		{text: "1"},
+		{text: ";", operator: true},
+		{text: "echo"},
+		{text: "done"},
+	})
+
+	_, err = shellWords(`cronner -l "oops`)
+	c.Assert(err, Not(IsNil))
+	c.Check(err.Error(), Equals, `unterminated " quote`)
+}
+
+func (*TestSuite) Test_cronnerInvocation(c *C) {
+	tests := []struct {
+		line string
+		args []string
+	}{
+		{"# 0 * * * * cronner -l test -- /bin/true", nil},
+		{"MAILTO=ops@example.com", nil},
+		{"0 * * * * /bin/true", nil},
+		{"0 * * * * /usr/local/bin/cronner -l test -- /bin/true", []string{"/usr/local/bin/cronner", "-l", "test", "--", "/bin/true"}},
+		{"@daily root cronner -k -l test -- /bin/true >/dev/null 2>&1", []string{"cronner", "-k", "-l", "test", "--", "/bin/true"}},
+		{"*/5 * * * * cd /tmp && cronner -l test -- ls | logger", []string{"cronner", "-l", "test", "--", "ls"}},
+	}
+
+	for _, test := range tests {
+		args, err := cronnerInvocation(test.line)
+		c.Assert(err, IsNil)
+		c.Check(args, DeepEquals, test.args, Commentf("line: %q", test.line))
+	}
+}
+
+func (*TestSuite) Test_validateCmd(c *C) {
+	dir := c.MkDir()
+	lockDir := c.MkDir()
+	missing := path.Join(dir, "missing")
+
+	crontab := path.Join(dir, "cronner.cron")
+	c.Assert(ioutil.WriteFile(crontab, []byte(fmt.Sprintf(`SHELL=/bin/sh
+# a comment
+0 * * * * root cronner -k -d %[1]v -l good -- /bin/true
+0 * * * * root cronner -l "bad!" -- /bin/true
+0 * * * * root cronner -l test -t 1tag -- /bin/true
+0 * * * * root cronner -k -d %[2]v -l test -- /bin/true
+0 * * * * root cronner -F --log-path %[2]v -l test -- /bin/true
+0 * * * * root cronner -L loud -l test -- /bin/true
+0 * * * * root cronner -l test
+0 * * * * root cronner -l test --user cronner-no-such-user -- /bin/true
+`, lockDir, missing)), 0644), IsNil)
+
+	config := path.Join(dir, "jobs.toml")
+	c.Assert(ioutil.WriteFile(config, []byte(fmt.Sprintf(`[defaults]
+lock-dir = "%v"
+lock = true
+
+[jobs.good]
+command = "/bin/true"
+
+[jobs.bad]
+label = "bad!"
+command = "/bin/true"
+
+[jobs.unknown]
+command = "/bin/true"
+bogus = true
+
+[jobs.loud]
+command = "/bin/true"
+group = "ops"
+log-level = "loud"
+`, lockDir)), 0644), IsNil)
+
+	var stdout, stderr bytes.Buffer
+
+	c.Check(validateCmd([]string{crontab, config}, &stdout, &stderr), Equals, 1)
+	c.Check(stderr.String(), Equals, "")
+	c.Check(strings.Split(stdout.String(), "\n"), DeepEquals, []string{
+		crontab + ":4: error: cron label 'bad!' is invalid, it can only be alphanumeric with underscores, periods, and spaces",
+		crontab + ":5: error: tag '1tag' is invalid, it must start with a letter",
+		crontab + ":6: error: lock directory '" + missing + "' does not exist",
+		crontab + ":7: error: log directory '" + missing + "' does not exist",
+		crontab + ":8: error: loud is not a known log level, try none, debug, info, or error",
+		crontab + ":9: error: you must specify a command to run either using by adding it to the end, or using the command flag",
+		crontab + ":10: error: user 'cronner-no-such-user' does not exist",
+		config + ":9: error: job 'bad': cron label 'bad!' is invalid, it can only be alphanumeric with underscores, periods, and spaces",
+		config + ":14: error: unknown option 'bogus'",
+		config + ":19: error: job 'loud': loud is not a known log level, try none, debug, info, or error",
+		"",
+	})
+
+	// a file with nothing wrong with it
+	c.Assert(ioutil.WriteFile(config, []byte(fmt.Sprintf("[jobs.good]\nlock-dir = %q\nlock = true\ncommand = \"/bin/true\"\n", lockDir)), 0644), IsNil)
+
+	stdout.Reset()
+	c.Check(validateCmd([]string{config}, &stdout, &stderr), Equals, 0)
+	c.Check(stdout.String(), Equals, "")
+
+	// a config file with a syntax error
+	c.Assert(ioutil.WriteFile(config, []byte("[jobs.good]\nlabel = \"good\n"), 0644), IsNil)
+
+	stdout.Reset()
+	c.Check(validateCmd([]string{"--type", "config", config}, &stdout, &stderr), Equals, 1)
+	c.Check(stdout.String(), Equals, config+":2: error: unescaped control character U+000A\n")
+
+	// a file that can't be read
+	stdout.Reset()
+	c.Check(validateCmd([]string{missing}, &stdout, &stderr), Equals, 1)
+	c.Check(strings.HasPrefix(stdout.String(), missing+":0: error: open "), Equals, true)
+
+	// a file is required
+	c.Check(validateCmd([]string{}, &stdout, &stderr), Equals, 1)
+	c.Check(stderr.String(), Equals, "error: at least one file to validate is required\n")
+
+	stderr.Reset()
+	c.Check(validateCmd([]string{"--type", "yaml", config}, &stdout, &stderr), Equals, 1)
+	c.Check(stderr.String(), Equals, "error: yaml is not a known file type, try auto, config, or crontab\n")
+}
+
+func (*TestSuite) Test_checkWritableDir(c *C) {
+	dir := c.MkDir()
+
+	c.Check(checkWritableDir("lock", dir), Equals, "")
+
+	file := path.Join(dir, "file")
+	c.Assert(ioutil.WriteFile(file, nil, 0644), IsNil)
+	c.Check(checkWritableDir("lock", file), Equals, fmt.Sprintf("lock directory '%v' is not a directory", file))
+
+	if os.Geteuid() == 0 {
+		// root can write anywhere
+		return
+	}
+
+	readOnly := path.Join(dir, "ro")
+	c.Assert(os.Mkdir(readOnly, 0500), IsNil)
+	c.Check(checkWritableDir("lock", readOnly), Equals, fmt.Sprintf("lock directory '%v' is not writable", readOnly))
+}